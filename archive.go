@@ -0,0 +1,115 @@
+package ftpfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"io"
+	iofs "io/fs"
+	"mime"
+	"net/http"
+	"path"
+)
+
+// ServeDirAsArchive writes the directory dir of fs and all its content
+// to w as a "tar" or "zip" archive, streamed as the files are retrieved
+// one at a time. Once the response has started, an error can only stop
+// it, leaving the archive truncated; the error is returned so the caller
+// may log it. An unknown format returns ErrInvalid before writing.
+func ServeDirAsArchive(w http.ResponseWriter, fs *FS, dir, format string) error {
+	var add func(name string, fi iofs.FileInfo, f iofs.File) error
+	var closer io.Closer
+	switch format {
+	case "tar":
+		tw := tar.NewWriter(w)
+		add = func(name string, fi iofs.FileInfo, f iofs.File) error {
+			h, err := tar.FileInfoHeader(fi, "")
+			if err != nil {
+				return err
+			}
+			h.Name = name
+			if f == nil {
+				h.Name += "/"
+				return tw.WriteHeader(h)
+			}
+			if s, ok := f.(interface{ Size() int64 }); ok {
+				// LIST may report a wrong size, tar needs the exact one
+				h.Size = s.Size()
+			}
+			if err := tw.WriteHeader(h); err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, f)
+			return err
+		}
+		closer = tw
+	case "zip":
+		zw := zip.NewWriter(w)
+		add = func(name string, fi iofs.FileInfo, f iofs.File) error {
+			h, err := zip.FileInfoHeader(fi)
+			if err != nil {
+				return err
+			}
+			h.Name = name
+			if f == nil {
+				h.Name += "/"
+				_, err = zw.CreateHeader(h)
+				return err
+			}
+			h.Method = zip.Deflate
+			fw, err := zw.CreateHeader(h)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(fw, f)
+			return err
+		}
+		closer = zw
+	default:
+		return ErrInvalid
+	}
+
+	fs.mu.Lock()
+	dir, err := fs.abs(dir)
+	dir = fs.unroot(dir) // as ioFS opens it again
+	fs.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	base := path.Base(dir)
+	if base == "/" {
+		base = "root"
+	}
+
+	if format == "tar" {
+		w.Header().Set("Content-Type", "application/x-tar")
+	} else {
+		w.Header().Set("Content-Type", "application/zip")
+	}
+	w.Header().Set("Content-Disposition",
+		mime.FormatMediaType("attachment", map[string]string{"filename": base + "." + format}))
+
+	fsys := ioFS{fs: fs, root: dir}
+	err = iofs.WalkDir(fsys, ".", func(rel string, d iofs.DirEntry, err error) error {
+		if err != nil || rel == "." {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		name := path.Join(base, rel)
+		if d.IsDir() {
+			return add(name, fi, nil)
+		}
+		f, err := fsys.Open(rel)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return add(name, fi, f)
+	})
+	if err != nil {
+		return err
+	}
+	return closer.Close()
+}
@@ -0,0 +1,68 @@
+package ftpfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeDirAsArchive(t *testing.T) {
+	files := map[string]string{
+		"/pub/a.txt":     "aaa",
+		"/pub/sub/b.txt": "bb",
+		"/pub/empty/":    "",
+		"/other.txt":     "x",
+	}
+	want := "pub/a.txt=aaa pub/empty/= pub/sub/= pub/sub/b.txt=bb"
+	for _, format := range []string{"tar", "zip"} {
+		w := httptest.NewRecorder()
+		if err := ServeDirAsArchive(w, NewConn(newFakeConn(files)), "/pub", format); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if cd := w.Header().Get("Content-Disposition"); cd != "attachment; filename=pub."+format {
+			t.Errorf("%s: Content-Disposition %q", format, cd)
+		}
+		var got []string
+		body := w.Body.Bytes()
+		if format == "tar" {
+			tr := tar.NewReader(bytes.NewReader(body))
+			for {
+				h, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, _ := io.ReadAll(tr)
+				got = append(got, h.Name+"="+string(b))
+			}
+		} else {
+			zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, zf := range zr.File {
+				rc, err := zf.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, _ := io.ReadAll(rc)
+				rc.Close()
+				got = append(got, zf.Name+"="+string(b))
+			}
+		}
+		if s := strings.Join(got, " "); s != want {
+			t.Errorf("%s archive has %s, want %s", format, s, want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	if err := ServeDirAsArchive(w, NewConn(newFakeConn(files)), "/pub", "rar"); err != ErrInvalid {
+		t.Fatalf("unknown format: %v, want ErrInvalid", err)
+	}
+}
@@ -0,0 +1,107 @@
+package ftpfs
+
+import (
+	"io"
+	"net/http"
+)
+
+// NewBufferedFile returns f keeping the last window bytes read in memory,
+// so that seeking back within them, as media players do, does not open a
+// new data connection. Other reads and seeks are passed to f.
+func NewBufferedFile(f http.File, window int) http.File {
+	if window <= 0 {
+		return f
+	}
+	return &bufferedFile{File: f, buf: make([]byte, window)}
+}
+
+// bufferedFile keeps the bytes of the file in [end-n, end) in buf. The
+// byte at position p is at buf[p%len(buf)].
+type bufferedFile struct {
+	http.File
+	buf   []byte
+	n     int64
+	end   int64
+	pos   int64 // position of the next Read
+	under int64 // position of File
+}
+
+func (f *bufferedFile) Read(b []byte) (int, error) {
+	if f.pos >= f.end-f.n && f.pos < f.end {
+		return f.readBuf(b), nil
+	}
+	if f.pos != f.under {
+		if _, err := f.File.Seek(f.pos, io.SeekStart); err != nil {
+			return 0, err
+		}
+		f.under = f.pos
+	}
+	if f.pos != f.end {
+		// not contiguous to the buffer
+		f.end, f.n = f.pos, 0
+	}
+	n, err := f.File.Read(b)
+	f.fill(b[:n])
+	f.under += int64(n)
+	f.pos = f.under
+	return n, err
+}
+
+// readBuf reads from the buffer at f.pos.
+func (f *bufferedFile) readBuf(b []byte) int {
+	w := int64(len(f.buf))
+	n := 0
+	for n < len(b) && f.pos < f.end {
+		i := f.pos % w
+		j := w
+		if rest := i + f.end - f.pos; rest < j {
+			j = rest
+		}
+		c := copy(b[n:], f.buf[i:j])
+		n += c
+		f.pos += int64(c)
+	}
+	return n
+}
+
+// fill appends b, read at f.end, to the buffer.
+func (f *bufferedFile) fill(b []byte) {
+	w := int64(len(f.buf))
+	if int64(len(b)) > w {
+		// only the last window bytes are kept
+		f.end += int64(len(b)) - w
+		b = b[int64(len(b))-w:]
+	}
+	f.n += int64(len(b))
+	if f.n > w {
+		f.n = w
+	}
+	for len(b) > 0 {
+		c := copy(f.buf[f.end%w:], b)
+		b = b[c:]
+		f.end += int64(c)
+	}
+}
+
+func (f *bufferedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		// Nothing to do
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		pos, err := f.File.Seek(offset, io.SeekEnd)
+		if err != nil {
+			return f.pos, err
+		}
+		f.under = pos
+		offset = pos
+	default:
+		return f.pos, ErrInvalid
+	}
+	if offset < 0 {
+		return f.pos, ErrInvalid
+	}
+	f.pos = offset
+	return offset, nil
+}
@@ -0,0 +1,51 @@
+package ftpfs
+
+import (
+	"io"
+	"testing"
+)
+
+// testData returns n bytes of text in which every 10 bytes differ.
+func testData(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = "0123456789abcdefghijklmnopqrstuvwxyz"[i/10%36]
+	}
+	return string(b)
+}
+
+func TestBufferedFile(t *testing.T) {
+	data := testData(5000)
+	c := newFakeConn(map[string]string{"/f": data})
+	f, err := NewConn(c).Open("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f = NewBufferedFile(f, 100)
+
+	read := func(pos, n int) {
+		t.Helper()
+		if _, err := f.Seek(int64(pos), io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(f, b); err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != data[pos:pos+n] {
+			t.Fatalf("read %q at %d, want %q", b, pos, data[pos:pos+n])
+		}
+	}
+	read(0, 3000)
+	// within the window
+	read(2900, 100)
+	read(2950, 80)
+	if n := c.count("RETR"); n != 1 {
+		t.Fatalf("%d RETR for seeks within the window, want 1", n)
+	}
+	// beyond it, and the buffer of the File
+	read(1000, 50)
+	if n := c.count("RETR"); n != 2 {
+		t.Fatalf("%d RETR after a seek beyond the window, want 2", n)
+	}
+}
@@ -0,0 +1,33 @@
+package ftpfs
+
+import "github.com/goftp/ftp"
+
+// encode converts name from UTF-8 to fs.Charset, for a command.
+func (fs *FS) encode(name string) (string, error) {
+	if fs.Charset == nil {
+		return name, nil
+	}
+	return fs.Charset.NewEncoder().String(name)
+}
+
+// decode converts s from fs.Charset to UTF-8, for a reply. Invalid bytes
+// are replaced rather than failing the command.
+func (fs *FS) decode(s string) string {
+	if fs.Charset == nil {
+		return s
+	}
+	if d, err := fs.Charset.NewDecoder().String(s); err == nil {
+		return d
+	}
+	return s
+}
+
+// decodeEntries converts the names of ls to UTF-8.
+func (fs *FS) decodeEntries(ls []*ftp.Entry) {
+	if fs.Charset == nil {
+		return
+	}
+	for _, e := range ls {
+		e.Name = fs.decode(e.Name)
+	}
+}
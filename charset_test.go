@@ -0,0 +1,40 @@
+package ftpfs
+
+import (
+	"io"
+	"testing"
+
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+func TestCharset(t *testing.T) {
+	// 中文 in GBK
+	const dir = "/\xd6\xd0\xce\xc4"
+	c := newFakeConn(map[string]string{dir + "/a.txt": "hello"})
+	fs := NewConn(c)
+	fs.Charset = simplifiedchinese.GBK
+
+	f, err := fs.Open("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := f.Readdir(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fi) != 1 || fi[0].Name() != "中文" {
+		t.Fatalf("Readdir = %v, want 中文", fi)
+	}
+
+	f, err = fs.Open("/中文/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if b, err := io.ReadAll(f); err != nil || string(b) != "hello" {
+		t.Fatalf("read %q, %v; want %q", b, err, "hello")
+	}
+	if c.count("RETR "+dir+"/a.txt") != 1 {
+		t.Fatalf("sent %q, want the name in GBK", c.sent)
+	}
+}
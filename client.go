@@ -0,0 +1,447 @@
+package ftpfs
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goftp/ftp"
+)
+
+var (
+	errActiveClient = errors.New("ftpfs: DialClient only opens passive data connections")
+	errPassiveReply = errors.New("ftpfs: malformed passive mode reply")
+	errPWDReply     = errors.New("ftpfs: malformed PWD reply")
+)
+
+// DialClient connects to the FTP server at addr with the FTP client of
+// this package, for Config.Dial. Unlike *ftp.ServerConn, it has Cmd,
+// FileSize, ListLines, NameList, Quit and TLSConnectionState, see Conn,
+// and its data streams can Abort, so every feature of FS works with it.
+//
+//	fs, err := ftpfs.DialWithConfig(addr, ftpfs.Config{
+//		User:     user,
+//		Password: pass,
+//		Dial:     ftpfs.DialClient,
+//	})
+//
+// It applies Config.Timeout, to the data connections too, and
+// Config.TLSConfig, with explicit TLS (AUTH TLS). Data connections are
+// passive, with EPSV or else PASV, so it fails with
+// Config.ActivePortMin/Max. Transfers are binary, unless
+// Config.TransferType says otherwise.
+func DialClient(addr string, cfg *Config) (Conn, error) {
+	if cfg.ActivePortMin != 0 || cfg.ActivePortMax != 0 {
+		return nil, errActiveClient
+	}
+	nc, err := net.DialTimeout("tcp", addr, cfg.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &client{conn: nc, text: textproto.NewConn(nc), timeout: cfg.Timeout}
+	if cfg.Timeout > 0 {
+		nc.SetDeadline(time.Now().Add(cfg.Timeout))
+	}
+	if err := c.greet(addr, cfg.TLSConfig); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	nc.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// client is the FTP client made by DialClient. FS serializes its use.
+type client struct {
+	conn    net.Conn // *tls.Conn after AUTH TLS
+	text    *textproto.Conn
+	timeout time.Duration
+	tls     *tls.Config // of the control connection, nil without TLS
+
+	prot    bool // PROT P accepted: data connections run over TLS
+	epsvAll bool // EPSV ALL accepted: PASV must not be sent
+	noEPSV  bool // EPSV refused, PASV is sent instead
+	typed   bool // TYPE sent
+}
+
+// greet reads the greeting of the server, and switches the control
+// connection to TLS with tlsConfig if not nil.
+func (c *client) greet(addr string, tlsConfig *tls.Config) error {
+	code, msg, err := c.text.ReadResponse(0)
+	for err == nil && code == 120 {
+		// ready in a few minutes
+		code, msg, err = c.text.ReadResponse(0)
+	}
+	if err != nil {
+		return err
+	}
+	if code != 220 {
+		return &textproto.Error{Code: code, Msg: msg}
+	}
+	if tlsConfig == nil {
+		return nil
+	}
+
+	if _, _, err := c.cmd(234, "AUTH TLS"); err != nil {
+		return err
+	}
+	cfg := tlsConfig.Clone()
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		cfg.ServerName = host
+	}
+	if cfg.ClientSessionCache == nil {
+		// servers often require data connections to resume the session
+		// of the control connection
+		cfg.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	tc := tls.Client(c.conn, cfg)
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	c.conn = tc
+	c.text = textproto.NewConn(tc)
+	c.tls = cfg
+	return nil
+}
+
+// cmd sends a command and reads its reply, see textproto.Reader.ReadResponse
+// for expected.
+func (c *client) cmd(expected int, format string, args ...interface{}) (int, string, error) {
+	id, err := c.text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+	return c.text.ReadResponse(expected)
+}
+
+// Cmd sends a raw command. The state of the session it changes, as with
+// PROT, TYPE or EPSV ALL, is kept for the next data connections.
+func (c *client) Cmd(expected int, format string, args ...interface{}) (int, string, error) {
+	code, msg, err := c.cmd(expected, format, args...)
+	if err != nil {
+		return code, msg, err
+	}
+	switch line := strings.ToUpper(fmt.Sprintf(format, args...)); {
+	case line == "PROT P":
+		c.prot = true
+	case line == "PROT C":
+		c.prot = false
+	case line == "EPSV ALL":
+		c.epsvAll = true
+	case strings.HasPrefix(line, "TYPE "):
+		c.typed = true
+	}
+	return code, msg, nil
+}
+
+// Login logs in as user. A 332 reply, asking for an account, is returned
+// as a *textproto.Error for FS to send ACCT.
+func (c *client) Login(user, password string) error {
+	code, msg, err := c.cmd(0, "USER %s", user)
+	if err != nil {
+		return err
+	}
+	switch code {
+	case 230:
+		return nil
+	case 331:
+		_, _, err = c.cmd(2, "PASS %s", password)
+		return err
+	}
+	return &textproto.Error{Code: code, Msg: msg}
+}
+
+func (c *client) Quit() error {
+	_, _, err := c.cmd(221, "QUIT")
+	if cerr := c.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (c *client) TLSConnectionState() (tls.ConnectionState, bool) {
+	tc, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return tc.ConnectionState(), true
+}
+
+func (c *client) ChangeDir(path string) error {
+	_, _, err := c.cmd(250, "CWD %s", path)
+	return err
+}
+
+func (c *client) CurrentDir() (string, error) {
+	_, msg, err := c.cmd(257, "PWD")
+	if err != nil {
+		return "", err
+	}
+	return parsePWD(msg)
+}
+
+// parsePWD returns the quoted directory of a PWD reply, like
+//
+//	"/a ""quoted"" dir" is the current directory
+func parsePWD(msg string) (string, error) {
+	i := strings.IndexByte(msg, '"')
+	if i < 0 {
+		return "", errPWDReply
+	}
+	var b strings.Builder
+	for s := msg[i+1:]; ; s = s[2:] {
+		j := strings.IndexByte(s, '"')
+		if j < 0 {
+			return "", errPWDReply
+		}
+		b.WriteString(s[:j])
+		s = s[j:]
+		if !strings.HasPrefix(s, `""`) {
+			return b.String(), nil
+		}
+		b.WriteByte('"')
+	}
+}
+
+func (c *client) FileSize(path string) (int64, error) {
+	_, msg, err := c.cmd(213, "SIZE %s", path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+}
+
+func (c *client) List(path string) ([]*ftp.Entry, error) {
+	lines, err := c.ListLines(path)
+	if err != nil {
+		return nil, err
+	}
+	var ls []*ftp.Entry
+	for _, line := range lines {
+		e, err := parseListLine(line)
+		if err != nil {
+			return nil, err
+		}
+		if e != nil {
+			ls = append(ls, e)
+		}
+	}
+	return ls, nil
+}
+
+func (c *client) ListLines(path string) ([]string, error) {
+	return c.lines("LIST", path)
+}
+
+func (c *client) NameList(path string) ([]string, error) {
+	return c.lines("NLST", path)
+}
+
+// lines issues the listing command verb for path, and returns the lines
+// of the data it sends.
+func (c *client) lines(verb, path string) ([]string, error) {
+	if path != "" {
+		verb += " " + path
+	}
+	s, err := c.transfer(0, "%s", verb)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	sc := bufio.NewScanner(s)
+	for sc.Scan() {
+		if line := strings.TrimRight(sc.Text(), "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	err = sc.Err()
+	if cerr := s.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+func (c *client) RetrFrom(path string, offset uint64) (io.ReadCloser, error) {
+	return c.transfer(offset, "RETR %s", path)
+}
+
+// transfer opens a data connection, restarts at offset if not zero, and
+// sends the transfer command. The data stream must be closed before the
+// next command.
+func (c *client) transfer(offset uint64, format string, args ...interface{}) (*dataStream, error) {
+	if !c.typed {
+		if _, _, err := c.cmd(200, "TYPE I"); err != nil {
+			return nil, err
+		}
+		c.typed = true
+	}
+	dc, err := c.dataConn()
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if _, _, err := c.cmd(350, "REST %d", offset); err != nil {
+			dc.Close()
+			return nil, err
+		}
+	}
+	if _, _, err := c.cmd(1, format, args...); err != nil {
+		dc.Close()
+		return nil, err
+	}
+	if c.prot {
+		tc := tls.Client(dc, c.tls)
+		if err := tc.Handshake(); err != nil {
+			dc.Close()
+			c.text.ReadResponse(0)
+			return nil, err
+		}
+		dc = tc
+	}
+	return &dataStream{c: c, conn: dc}, nil
+}
+
+// dataConn opens a passive data connection. The host of the PASV reply
+// is ignored for the one of the control connection, as servers behind NAT
+// often give their private address.
+func (c *client) dataConn() (net.Conn, error) {
+	host, _, err := net.SplitHostPort(c.conn.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	port, err := c.passivePort()
+	if err != nil {
+		return nil, err
+	}
+	return net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), c.timeout)
+}
+
+// passivePort asks for a passive data port, with EPSV, or PASV if the
+// server does not implement EPSV.
+func (c *client) passivePort() (int, error) {
+	if !c.noEPSV {
+		code, msg, err := c.cmd(229, "EPSV")
+		if err == nil {
+			return parseEPSV(msg)
+		}
+		if !notImplemented(code) || c.epsvAll {
+			return 0, err
+		}
+		c.noEPSV = true
+	}
+	_, msg, err := c.cmd(227, "PASV")
+	if err != nil {
+		return 0, err
+	}
+	return parsePASV(msg)
+}
+
+// parseEPSV returns the port of an EPSV reply, like
+//
+//	Entering Extended Passive Mode (|||6446|)
+func parseEPSV(msg string) (int, error) {
+	i := strings.IndexByte(msg, '(')
+	j := strings.LastIndexByte(msg, ')')
+	if i < 0 || j < i+2 {
+		return 0, errPassiveReply
+	}
+	f := strings.Split(msg[i+1:j], msg[i+1:i+2])
+	if len(f) != 5 {
+		return 0, errPassiveReply
+	}
+	port, err := strconv.Atoi(f[3])
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, errPassiveReply
+	}
+	return port, nil
+}
+
+// parsePASV returns the port of a PASV reply, like
+//
+//	Entering Passive Mode (192,168,1,2,25,46).
+func parsePASV(msg string) (int, error) {
+	i := strings.IndexAny(msg, "0123456789")
+	if i < 0 {
+		return 0, errPassiveReply
+	}
+	s := msg[i:]
+	if j := strings.IndexFunc(s, func(r rune) bool { return r != ',' && (r < '0' || r > '9') }); j >= 0 {
+		s = s[:j]
+	}
+	f := strings.Split(s, ",")
+	if len(f) != 6 {
+		return 0, errPassiveReply
+	}
+	hi, err1 := strconv.Atoi(f[4])
+	lo, err2 := strconv.Atoi(f[5])
+	if err1 != nil || err2 != nil || hi > 255 || lo > 255 {
+		return 0, errPassiveReply
+	}
+	return hi<<8 | lo, nil
+}
+
+// dataStream is the data connection of a transfer. Closing it reads the
+// reply ending the transfer.
+type dataStream struct {
+	c    *client
+	conn net.Conn
+	done bool
+}
+
+func (s *dataStream) Read(b []byte) (int, error) {
+	return s.conn.Read(b)
+}
+
+func (s *dataStream) SetReadDeadline(t time.Time) error {
+	return s.conn.SetReadDeadline(t)
+}
+
+func (s *dataStream) Close() error {
+	if s.done {
+		return nil
+	}
+	s.done = true
+	s.conn.Close()
+	_, _, err := s.c.text.ReadResponse(2)
+	return err
+}
+
+// Abort stops the transfer with ABOR. The server replies to the transfer,
+// usually with 426, before the reply to ABOR.
+func (s *dataStream) Abort() error {
+	if s.done {
+		return nil
+	}
+	s.done = true
+	if err := s.c.text.PrintfLine("ABOR"); err != nil {
+		s.conn.Close()
+		return err
+	}
+	s.conn.Close()
+	code, msg, err := s.c.text.ReadResponse(0)
+	if err == nil && code/100 == 4 {
+		code, msg, err = s.c.text.ReadResponse(0)
+	}
+	if err != nil {
+		return err
+	}
+	if code/100 != 2 {
+		return &textproto.Error{Code: code, Msg: msg}
+	}
+	return nil
+}
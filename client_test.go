@@ -0,0 +1,497 @@
+package ftpfs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goftp/ftp"
+)
+
+// testServer is a FTP server on the loopback interface serving files as
+// a fakeConn does, for tests of DialClient. The commands it gets are
+// recorded in sent.
+type testServer struct {
+	ln     net.Listener
+	files  map[string]string
+	noEPSV bool        // EPSV is not implemented
+	stall  string      // a file whose transfer never ends, until ABOR
+	tls    *tls.Config // AUTH TLS is accepted with it, if not nil
+
+	mu   sync.Mutex
+	sent []string
+}
+
+func newTestServer(t *testing.T, files map[string]string) *testServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("no loopback interface: %v", err)
+	}
+	s := &testServer{ln: ln, files: files}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *testServer) addr() string { return s.ln.Addr().String() }
+
+// log returns the commands sent so far.
+func (s *testServer) log() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.sent...)
+}
+
+func (s *testServer) count(verb string) int {
+	return (&fakeConn{sent: s.log()}).count(verb)
+}
+
+// session is the state of a connection to a testServer.
+type session struct {
+	s     *testServer
+	conn  net.Conn
+	text  *textproto.Conn
+	fc    *fakeConn
+	pasv  net.Listener // of the next data connection
+	rest  uint64
+	prot  bool
+	abort chan struct{} // closed by ABOR
+	done  chan struct{} // closed once the transfer in progress replied
+}
+
+func (s *testServer) serve(c net.Conn) {
+	defer c.Close()
+	ss := &session{s: s, conn: c, text: textproto.NewConn(c), fc: newFakeConn(s.files)}
+	ss.text.PrintfLine("220 Test server ready")
+	for {
+		line, err := ss.text.ReadLine()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.sent = append(s.sent, line)
+		s.mu.Unlock()
+		verb, arg, _ := strings.Cut(line, " ")
+		verb = strings.ToUpper(verb)
+		if verb == "ABOR" {
+			ss.abortTransfer()
+			continue
+		}
+		ss.wait()
+		if !ss.handle(verb, arg) {
+			return
+		}
+	}
+}
+
+// wait waits for the transfer in progress, if any, to reply.
+func (ss *session) wait() {
+	if ss.done != nil {
+		<-ss.done
+		ss.done = nil
+	}
+}
+
+func (ss *session) abortTransfer() {
+	if ss.done == nil {
+		ss.text.PrintfLine("226 No transfer to abort")
+		return
+	}
+	close(ss.abort)
+	ss.wait()
+	ss.text.PrintfLine("226 Abort successful")
+}
+
+func (ss *session) handle(verb, arg string) bool {
+	reply := func(format string, args ...interface{}) {
+		ss.text.PrintfLine(format, args...)
+	}
+	switch verb {
+	case "USER":
+		reply("331 Password required")
+	case "PASS":
+		reply("230 Logged in")
+	case "TYPE":
+		reply("200 Type set to %s", arg)
+	case "PWD":
+		dir, _ := ss.fc.CurrentDir()
+		reply(`257 "%s" is the current directory`, strings.ReplaceAll(dir, `"`, `""`))
+	case "CWD":
+		if err := ss.fc.ChangeDir(arg); err != nil {
+			reply("550 No such directory")
+			break
+		}
+		reply("250 Directory changed")
+	case "SIZE":
+		content, ok := ss.fc.files[ss.fc.abs(arg)]
+		if !ok {
+			reply("550 No such file")
+			break
+		}
+		reply("213 %d", len(content))
+	case "FEAT":
+		reply("211-Features:")
+		reply(" MLST type*;size*;modify*;unique*;")
+		reply(" SIZE")
+		reply("211 End")
+	case "MLST":
+		name := ss.fc.abs(arg)
+		facts := "type=dir;"
+		if _, ok := ss.fc.dirs[name]; !ok {
+			e := ss.fc.entry(name)
+			if e == nil {
+				reply("550 No such file")
+				break
+			}
+			facts = fmt.Sprintf("type=file;size=%d;", e.Size)
+		}
+		reply("250-Listing %s", name)
+		reply(" %smodify=%s;unique=U%s; %s", facts, fakeTime.Format("20060102150405"), name, name)
+		reply("250 End")
+	case "SITE":
+		reply("200 SITE command successful")
+	case "AUTH":
+		if ss.s.tls == nil || arg != "TLS" {
+			reply("502 Not implemented")
+			break
+		}
+		reply("234 Proceed with negotiation")
+		tc := tls.Server(ss.conn, ss.s.tls)
+		if err := tc.Handshake(); err != nil {
+			return false
+		}
+		ss.conn = tc
+		ss.text = textproto.NewConn(tc)
+	case "PBSZ":
+		reply("200 PBSZ=0")
+	case "PROT":
+		ss.prot = arg == "P"
+		reply("200 Protection level set to %s", arg)
+	case "EPSV", "PASV":
+		if verb == "EPSV" && ss.s.noEPSV {
+			reply("502 Not implemented")
+			break
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			reply("425 Can not open data connection")
+			break
+		}
+		ss.pasv = ln
+		port := ln.Addr().(*net.TCPAddr).Port
+		if verb == "EPSV" {
+			reply("229 Entering Extended Passive Mode (|||%d|)", port)
+		} else {
+			// a wrong host, which is ignored
+			reply("227 Entering Passive Mode (10,0,0,1,%d,%d).", port>>8, port&0xff)
+		}
+	case "REST":
+		n, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			reply("501 Bad offset")
+			break
+		}
+		ss.rest = n
+		reply("350 Restarting at %d", n)
+	case "RETR", "LIST", "NLST":
+		ss.transfer(verb, arg)
+	case "QUIT":
+		reply("221 Goodbye")
+		return false
+	default:
+		reply("502 Not implemented")
+	}
+	return true
+}
+
+// transfer sends the data of verb for arg over the passive connection,
+// and replies once done, or aborted.
+func (ss *session) transfer(verb, arg string) {
+	ln, offset := ss.pasv, ss.rest
+	ss.pasv, ss.rest = nil, 0
+	if ln == nil {
+		ss.text.PrintfLine("425 Use PASV or EPSV first")
+		return
+	}
+	defer ln.Close()
+
+	var data string
+	switch name := ss.fc.abs(arg); verb {
+	case "RETR":
+		content, ok := ss.fc.files[name]
+		if !ok {
+			ss.text.PrintfLine("550 No such file")
+			return
+		}
+		if offset < uint64(len(content)) {
+			data = content[offset:]
+		}
+	case "LIST", "NLST":
+		if arg == "" {
+			name = ss.fc.cwd
+		}
+		ls, ok := ss.fc.dirs[name]
+		if !ok {
+			ss.text.PrintfLine("550 No such directory")
+			return
+		}
+		for _, e := range ls {
+			if verb == "NLST" {
+				data += e.Name + "\r\n"
+				continue
+			}
+			mode := "-rw-r--r--"
+			if e.Type == ftp.EntryTypeFolder {
+				mode = "drwxr-xr-x"
+			}
+			data += fmt.Sprintf("%s 1 owner group %d %s %s\r\n", mode, e.Size, e.Time.Format("Jan _2  2006"), e.Name)
+		}
+	}
+	ss.text.PrintfLine("150 Opening data connection")
+	dc, err := ln.Accept()
+	if err != nil {
+		ss.text.PrintfLine("425 Can not open data connection")
+		return
+	}
+	if ss.prot {
+		tc := tls.Server(dc, ss.s.tls)
+		if err := tc.Handshake(); err != nil {
+			dc.Close()
+			ss.text.PrintfLine("522 TLS required")
+			return
+		}
+		dc = tc
+	}
+
+	// the data is sent while the session reads ABOR
+	ss.abort = make(chan struct{})
+	ss.done = make(chan struct{})
+	stall := verb == "RETR" && ss.fc.abs(arg) == ss.s.stall
+	go func(abort, done chan struct{}) {
+		defer close(done)
+		_, err := io.WriteString(dc, data)
+		if stall && err == nil {
+			<-abort
+			err = io.ErrClosedPipe
+		}
+		dc.Close()
+		if err != nil {
+			ss.text.PrintfLine("426 Transfer aborted")
+			return
+		}
+		ss.text.PrintfLine("226 Transfer complete")
+	}(ss.abort, ss.done)
+}
+
+// testCert returns a self-signed certificate for 127.0.0.1, and the pool
+// to verify it.
+func testCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ftpfs test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func dialTestServer(t *testing.T, s *testServer, cfg Config) *FS {
+	t.Helper()
+	cfg.User, cfg.Password = "user", "pass"
+	cfg.Dial = DialClient
+	cfg.Timeout = 5 * time.Second
+	fs, err := DialWithConfig(s.addr(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fs.Close() })
+	return fs
+}
+
+func TestDialClient(t *testing.T) {
+	s := newTestServer(t, map[string]string{"/d/a.txt": "0123456789", "/d/b.txt": "b"})
+	fs := dialTestServer(t, s, Config{})
+	f, err := fs.Open("/d/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil || string(b) != "0123456789" {
+		t.Fatalf("ReadAll = %q, %v", b, err)
+	}
+	rc, err := fs.OpenAt("/d/a.txt", 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(rc); err != nil || string(b) != "6789" {
+		t.Fatalf("ReadAll from 6 = %q, %v", b, err)
+	}
+	rc.Close()
+
+	// the features built on Cmd work too
+	fi, err := fs.Stat("/d/a.txt")
+	if err != nil || fi.Size() != 10 {
+		t.Fatalf("Stat = %v, %v", fi, err)
+	}
+	if u, ok := fi.(interface{ Unique() string }); !ok || u.Unique() != "U/d/a.txt" {
+		t.Fatalf("Stat of /d/a.txt has no unique fact from MLST")
+	}
+	if err := fs.Chmod("/d/a.txt", 0600); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+	if err := fs.ChangeDir("/d"); err != nil {
+		t.Fatal(err)
+	}
+	if dir, err := fs.CurrentDir(); err != nil || dir != "/d" {
+		t.Fatalf("CurrentDir = %q, %v", dir, err)
+	}
+	if names, err := fs.ListNames("."); err != nil || strings.Join(names, " ") != "a.txt b.txt" {
+		t.Fatalf("ListNames = %q, %v", names, err)
+	}
+	d, err := fs.Open("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := d.Readdir(0); err != nil || names(fi) != "a.txt b.txt" {
+		t.Fatalf("Readdir = %v, %v", fi, err)
+	}
+	for _, verb := range []string{"EPSV", "TYPE", "REST", "MLST", "SITE", "NLST"} {
+		if s.count(verb) == 0 {
+			t.Errorf("sent %q, want %s", s.log(), verb)
+		}
+	}
+	if fs.IsSecure() {
+		t.Errorf("IsSecure() = true without TLS")
+	}
+}
+
+func TestDialClientPASV(t *testing.T) {
+	s := newTestServer(t, map[string]string{"/a.txt": "hello"})
+	s.noEPSV = true
+	fs := dialTestServer(t, s, Config{})
+	for i := 0; i < 2; i++ {
+		f, err := fs.Open("/a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := io.ReadAll(f); err != nil || string(b) != "hello" {
+			t.Fatalf("ReadAll = %q, %v", b, err)
+		}
+		f.Close()
+	}
+	if n := s.count("EPSV"); n != 1 || s.count("PASV") != 2 {
+		t.Fatalf("sent %q, want EPSV once then PASV", s.log())
+	}
+}
+
+func TestDialClientAbort(t *testing.T) {
+	s := newTestServer(t, map[string]string{"/a.txt": "0123456789"})
+	s.stall = "/a.txt"
+	fs := dialTestServer(t, s, Config{})
+	f, err := fs.Open("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(f, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close of a transfer in progress: %v", err)
+	}
+	if s.count("ABOR") != 1 {
+		t.Fatalf("sent %q, want ABOR", s.log())
+	}
+	// the control connection is in sync after ABOR
+	if fi, err := fs.Stat("/a.txt"); err != nil || fi.Size() != 10 {
+		t.Fatalf("Stat after ABOR = %v, %v", fi, err)
+	}
+}
+
+func TestDialClientTLS(t *testing.T) {
+	cert, pool := testCert(t)
+	s := newTestServer(t, map[string]string{"/a.txt": "secret"})
+	s.tls = &tls.Config{Certificates: []tls.Certificate{cert}}
+	fs := dialTestServer(t, s, Config{TLSConfig: &tls.Config{RootCAs: pool}})
+	if !fs.IsSecure() || !fs.IsDataSecure() {
+		t.Fatalf("IsSecure() = %t, IsDataSecure() = %t; want both", fs.IsSecure(), fs.IsDataSecure())
+	}
+	f, err := fs.Open("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(f); err != nil || string(b) != "secret" {
+		t.Fatalf("ReadAll over TLS = %q, %v", b, err)
+	}
+	if s.count("PROT P") != 1 {
+		t.Fatalf("sent %q, want PROT P", s.log())
+	}
+}
+
+func TestParsePassive(t *testing.T) {
+	for _, tt := range []struct {
+		parse func(string) (int, error)
+		msg   string
+		port  int
+	}{
+		{parseEPSV, "Entering Extended Passive Mode (|||6446|)", 6446},
+		{parseEPSV, "Entering Extended Passive Mode (!!!6446!)", 6446},
+		{parseEPSV, "Entering Extended Passive Mode", 0},
+		{parsePASV, "Entering Passive Mode (192,168,1,2,25,46).", 25<<8 | 46},
+		{parsePASV, "Entering Passive Mode 192,168,1,2,25,46", 25<<8 | 46},
+		{parsePASV, "Entering Passive Mode (192,168,1,2)", 0},
+	} {
+		port, err := tt.parse(tt.msg)
+		if tt.port == 0 {
+			if err != errPassiveReply {
+				t.Errorf("%q: %d, %v; want errPassiveReply", tt.msg, port, err)
+			}
+			continue
+		}
+		if err != nil || port != tt.port {
+			t.Errorf("%q: %d, %v; want %d", tt.msg, port, err, tt.port)
+		}
+	}
+	if dir, err := parsePWD(`"/a ""b""" is the current directory`); err != nil || dir != `/a "b"` {
+		t.Errorf("parsePWD = %q, %v", dir, err)
+	}
+}
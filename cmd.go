@@ -0,0 +1,322 @@
+package ftpfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cmder is implemented by FTP clients which can send a raw command on the
+// control connection. expected is the reply code that means success, as
+// in textproto.Reader.ReadResponse: 2 accepts any 2xx code. The reply
+// code is returned even when err is not nil.
+type cmder interface {
+	Cmd(expected int, format string, args ...interface{}) (code int, msg string, err error)
+}
+
+var errChecksum = errors.New("ftpfs: malformed checksum reply")
+
+// cmd sends a raw command if the FTP client supports it, otherwise it
+// returns ErrUnsupported. fs.mu must be held.
+func (fs *FS) cmd(expected int, format string, args ...interface{}) (int, string, error) {
+	c, ok := fs.conn.(cmder)
+	if !ok {
+		return 0, "", ErrUnsupported
+	}
+	fs.idle()
+	fs.debugf("> "+format, args...)
+	line, err := fs.encode(fmt.Sprintf(format, args...))
+	if err != nil {
+		return 0, "", err
+	}
+	code, msg, err := c.Cmd(expected, "%s", line)
+	msg = fs.decode(msg)
+	if err == nil {
+		fs.debugf("< %d %s", code, msg)
+	} else {
+		fs.debugReply(err)
+	}
+	if err != nil && notImplemented(code) {
+		err = ErrUnsupported
+	}
+	return code, msg, err
+}
+
+// notImplemented reports whether code means the server does not know or
+// implement the command.
+func notImplemented(code int) bool {
+	return code == 500 || code == 502 || code == 504
+}
+
+// features issues FEAT on first use and returns the features advertised
+// by the server, keyed by upper-cased name with their parameters.
+func (fs *FS) features() (map[string]string, error) {
+	if fs.feat != nil {
+		return fs.feat, nil
+	}
+	_, msg, err := fs.cmd(211, "FEAT")
+	if err == ErrUnsupported && fs.canCmd() {
+		// server without FEAT advertises nothing
+		fs.feat = map[string]string{}
+		return fs.feat, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	feat := make(map[string]string)
+	for _, line := range strings.Split(msg, "\n") {
+		// feature lines are indented by a space
+		if !strings.HasPrefix(line, " ") {
+			continue
+		}
+		line = strings.TrimSpace(line)
+		name, param := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			name, param = line[:i], line[i+1:]
+		}
+		feat[strings.ToUpper(name)] = param
+	}
+	fs.feat = feat
+	return feat, nil
+}
+
+// hasFeature reports whether the server advertises name in FEAT.
+func (fs *FS) hasFeature(name string) (bool, error) {
+	feat, err := fs.features()
+	if err != nil {
+		return false, err
+	}
+	_, ok := feat[name]
+	return ok, nil
+}
+
+// canCmd reports whether the FTP client can send raw commands.
+func (fs *FS) canCmd() bool {
+	_, ok := fs.conn.(cmder)
+	return ok
+}
+
+// Chmod issues SITE CHMOD to change the permission bits of name.
+// Only the permission bits of mode are sent.
+// It returns ErrUnsupported if the server does not implement SITE CHMOD,
+// and always with a Conn which can not send raw commands, as
+// *ftp.ServerConn; see Conn.
+func (fs *FS) Chmod(name string, mode os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name, err := fs.abs(name)
+	if err != nil {
+		return err
+	}
+	_, _, err = fs.cmd(200, "SITE CHMOD %03o %s", uint32(mode.Perm()), name)
+	return err
+}
+
+// Site issues SITE with args, e.g. "UMASK 022", and returns the reply
+// message. It is an advanced escape hatch to commands specific to a
+// server; the reply is not interpreted beyond its 2xx code.
+// It returns ErrUnsupported if the server does not implement the command,
+// or if the Conn has no Cmd method, as *ftp.ServerConn.
+func (fs *FS) Site(args string) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	_, msg, err := fs.cmd(2, "SITE %s", args)
+	return msg, err
+}
+
+// Chtimes issues MFMT to set the modification time of name.
+// The time is sent in UTC.
+// It returns ErrUnsupported if the server does not advertise MFMT. MFMT
+// and FEAT are raw commands, which need a Conn with Cmd, so it does too
+// with *ftp.ServerConn.
+func (fs *FS) Chtimes(name string, mtime time.Time) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name, err := fs.abs(name)
+	if err != nil {
+		return err
+	}
+	ok, err := fs.hasFeature("MFMT")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrUnsupported
+	}
+	_, _, err = fs.cmd(213, "MFMT %s %s", mtime.UTC().Format("20060102150405"), name)
+	return err
+}
+
+// modTime returns the modification time of name with MDTM.
+// It returns ErrUnsupported if the server does not implement MDTM.
+func (fs *FS) modTime(name string) (time.Time, error) {
+	_, msg, err := fs.cmd(213, "MDTM %s", name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	// 20060102150405, maybe with fractions of second
+	v := strings.TrimSpace(msg)
+	if i := strings.IndexByte(v, '.'); i >= 0 {
+		v = v[:i]
+	}
+	return time.Parse("20060102150405", v)
+}
+
+// xHash lists the commands computing a checksum, by algorithm.
+var xHash = map[string]string{
+	"CRC32":   "XCRC",
+	"MD5":     "XMD5",
+	"SHA-1":   "XSHA1",
+	"SHA-256": "XSHA256",
+	"SHA-512": "XSHA512",
+}
+
+// Checksum returns the hex digest of name computed by the server, with
+// algo one of CRC32, MD5, SHA-1, SHA-256 or SHA-512. It uses HASH, or
+// the XCRC, XMD5 and XSHA commands, as advertised in FEAT.
+// It returns ErrUnsupported if the server advertises none for algo. All
+// are raw commands: with a Conn without Cmd, as *ftp.ServerConn, it
+// always returns ErrUnsupported.
+func (fs *FS) Checksum(name, algo string) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name, err := fs.abs(name)
+	if err != nil {
+		return "", err
+	}
+	algo = strings.ToUpper(algo)
+	feat, err := fs.features()
+	if err != nil {
+		return "", err
+	}
+
+	if algos, ok := feat["HASH"]; ok {
+		// e.g. "SHA-1;SHA-256*;MD5", * marks the selected one
+		for _, a := range strings.Split(algos, ";") {
+			if strings.TrimSuffix(a, "*") != algo {
+				continue
+			}
+			if !strings.HasSuffix(a, "*") {
+				if _, _, err := fs.cmd(200, "OPTS HASH %s", algo); err != nil {
+					return "", err
+				}
+				fs.feat = nil // selection changed
+			}
+			// 213 SHA-256 0-49 169cd22282da7f147cb491e559e9dd filename
+			_, msg, err := fs.cmd(213, "HASH %s", name)
+			if err != nil {
+				return "", err
+			}
+			if f := strings.Fields(msg); len(f) >= 3 {
+				return strings.ToLower(f[2]), nil
+			}
+			return "", errChecksum
+		}
+	}
+
+	c, ok := xHash[algo]
+	if _, adv := feat[c]; !ok || !adv {
+		return "", ErrUnsupported
+	}
+	_, msg, err := fs.cmd(2, "%s %s", c, name)
+	if err != nil {
+		return "", err
+	}
+	if f := strings.Fields(msg); len(f) > 0 {
+		return strings.ToLower(f[0]), nil
+	}
+	return "", errChecksum
+}
+
+// Help returns the reply of HELP, which usually lists the commands the
+// server supports. The reply is cached for the connection. It returns
+// ErrUnsupported with a Conn which can not send raw commands, as
+// *ftp.ServerConn.
+func (fs *FS) Help() (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.help != nil {
+		return *fs.help, nil
+	}
+	_, msg, err := fs.cmd(2, "HELP")
+	if err != nil {
+		return "", err
+	}
+	fs.help = &msg
+	return msg, nil
+}
+
+// AvailableSpace returns the bytes that can still be stored in the
+// directory name, or -1 if there is no limit. It uses AVBL if the server
+// advertises it in FEAT, otherwise the upload quota of SITE QUOTA, as by
+// ProFTPD. It returns ErrUnsupported if neither is available, which is
+// always the case with a Conn without Cmd, as *ftp.ServerConn.
+func (fs *FS) AvailableSpace(name string) (int64, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name, err := fs.abs(name)
+	if err != nil {
+		return 0, err
+	}
+	ok, err := fs.hasFeature("AVBL")
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		_, msg, err := fs.cmd(213, "AVBL %s", name)
+		if err != nil {
+			return 0, err
+		}
+		return strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+	}
+
+	_, msg, err := fs.cmd(2, "SITE QUOTA")
+	if err != nil {
+		if replyCode(err) >= 500 {
+			err = ErrUnsupported
+		}
+		return 0, err
+	}
+	return parseQuota(msg)
+}
+
+// parseQuota returns the space left by the upload quota of a SITE QUOTA
+// reply, which has a line like
+//
+//	Uploaded bytes:	1024.00/1048576.00
+func parseQuota(msg string) (int64, error) {
+	for _, line := range strings.Split(msg, "\n") {
+		_, v, ok := strings.Cut(line, "Uploaded bytes:")
+		if !ok {
+			continue
+		}
+		v = strings.TrimSpace(v)
+		if v == "unlimited" {
+			return -1, nil
+		}
+		used, limit, ok := strings.Cut(v, "/")
+		if !ok {
+			break
+		}
+		u, err1 := strconv.ParseFloat(used, 64)
+		l, err2 := strconv.ParseFloat(limit, 64)
+		if err1 != nil || err2 != nil {
+			break
+		}
+		if l <= u {
+			return 0, nil
+		}
+		return int64(l - u), nil
+	}
+	return 0, ErrUnsupported
+}
@@ -0,0 +1,150 @@
+package ftpfs
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestChmod(t *testing.T) {
+	c := cmdConn{newFakeConn(map[string]string{"/d/a.txt": "a"}), map[string]string{
+		"SITE CHMOD 755 /d/a.txt": "200 SITE CHMOD command successful",
+	}}
+	fs := NewConn(c)
+	if err := fs.Chmod("/d/a.txt", os.ModeSetuid|0755); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.sent[len(c.sent)-1], "SITE CHMOD 755 /d/a.txt"; got != want {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+
+	if err := fs.Chmod("/d/b.txt", 0644); err != ErrUnsupported {
+		t.Errorf("Chmod with a 502 reply: %v, want ErrUnsupported", err)
+	}
+	if err := NewConn(newFakeConn(nil)).Chmod("/a", 0644); err != ErrUnsupported {
+		t.Errorf("Chmod without Cmd: %v, want ErrUnsupported", err)
+	}
+}
+
+func TestChtimes(t *testing.T) {
+	c := cmdConn{newFakeConn(map[string]string{"/a.txt": "a"}), map[string]string{
+		"FEAT":                       "211 Features:\n MDTM\n MFMT\nEnd",
+		"MFMT 20200102030405 /a.txt": "213 Modify=20200102030405; /a.txt",
+	}}
+	fs := NewConn(c)
+	hk := time.FixedZone("HKT", 8*60*60)
+	if err := fs.Chtimes("/a.txt", time.Date(2020, 1, 2, 11, 4, 5, 0, hk)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.sent[len(c.sent)-1], "MFMT 20200102030405 /a.txt"; got != want {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+
+	c.replies["FEAT"] = "211 Features:\n MDTM\nEnd"
+	fs = NewConn(c)
+	if err := fs.Chtimes("/a.txt", time.Now()); err != ErrUnsupported {
+		t.Errorf("Chtimes without MFMT in FEAT: %v, want ErrUnsupported", err)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	c := cmdConn{newFakeConn(map[string]string{"/a.txt": "a"}), map[string]string{
+		"FEAT":        "211 Features:\n HASH SHA-1;SHA-256*\n XCRC\nEnd",
+		"HASH /a.txt": "213 SHA-256 0-1 CA978112CA1BBDCAFAC231B39A23DC4DA786EFF8147C4E72B9807785AFEE48BB /a.txt",
+		"XCRC /a.txt": "250 E8B7BE43",
+	}}
+	fs := NewConn(c)
+	for _, tt := range []struct {
+		algo, cmd, want string
+	}{
+		{"SHA-256", "HASH /a.txt", "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb"},
+		{"crc32", "XCRC /a.txt", "e8b7be43"},
+	} {
+		sum, err := fs.Checksum("/a.txt", tt.algo)
+		if err != nil {
+			t.Fatalf("Checksum %s: %v", tt.algo, err)
+		}
+		if sum != tt.want {
+			t.Errorf("Checksum %s = %q, want %q", tt.algo, sum, tt.want)
+		}
+		if got := c.sent[len(c.sent)-1]; got != tt.cmd {
+			t.Errorf("Checksum %s sent %q, want %q", tt.algo, got, tt.cmd)
+		}
+	}
+	if _, err := fs.Checksum("/a.txt", "MD5"); err != ErrUnsupported {
+		t.Errorf("Checksum MD5: %v, want ErrUnsupported", err)
+	}
+}
+
+func TestHelp(t *testing.T) {
+	reply := "The following commands are recognized:\n CWD LIST PASV PWD RETR SIZE TYPE USER\nHelp OK."
+	c := cmdConn{newFakeConn(nil), map[string]string{"HELP": "214 " + reply}}
+	fs := NewConn(c)
+	for i := 0; i < 2; i++ {
+		msg, err := fs.Help()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg != reply {
+			t.Fatalf("Help() = %q, want %q", msg, reply)
+		}
+	}
+	if n := c.count("HELP"); n != 1 {
+		t.Fatalf("%d HELP sent, want 1 as the reply is cached", n)
+	}
+}
+
+func TestAvailableSpace(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		replies map[string]string
+		cmd     string
+		want    int64
+		err     error
+	}{
+		{"AVBL", map[string]string{
+			"FEAT":    "211 Features:\n AVBL\nEnd",
+			"AVBL /d": "213 1048576",
+		}, "AVBL /d", 1048576, nil},
+		{"SITE QUOTA", map[string]string{
+			"FEAT":       "211 Features:\n MDTM\nEnd",
+			"SITE QUOTA": "200 The current quota for this session are [current/limit]:\nName: user\nUploaded bytes:\t1024.00/4096.00\nFiles uploaded:\t1/unlimited",
+		}, "SITE QUOTA", 3072, nil},
+		{"unlimited", map[string]string{
+			"SITE QUOTA": "200 The current quota:\nUploaded bytes:\tunlimited",
+		}, "SITE QUOTA", -1, nil},
+		{"none", map[string]string{
+			"SITE QUOTA": "500 'SITE QUOTA': command not understood",
+		}, "SITE QUOTA", 0, ErrUnsupported},
+	} {
+		c := cmdConn{newFakeConn(map[string]string{"/d/": ""}), tt.replies}
+		n, err := NewConn(c).AvailableSpace("/d")
+		if n != tt.want || err != tt.err {
+			t.Errorf("%s: AvailableSpace = %d, %v; want %d, %v", tt.name, n, err, tt.want, tt.err)
+		}
+		if got := c.sent[len(c.sent)-1]; got != tt.cmd {
+			t.Errorf("%s: sent %q, want %q", tt.name, got, tt.cmd)
+		}
+	}
+}
+
+func TestSite(t *testing.T) {
+	c := cmdConn{newFakeConn(nil), map[string]string{"SITE UMASK 022": "200 UMASK set to 022 (was 027)"}}
+	fs := NewConn(c)
+	msg, err := fs.Site("UMASK 022")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg != "UMASK set to 022 (was 027)" {
+		t.Fatalf("Site() = %q, want the reply message", msg)
+	}
+	if c.sent[0] != "SITE UMASK 022" {
+		t.Fatalf("sent %q, want SITE UMASK 022", c.sent)
+	}
+	if _, err := fs.Site("ZONE"); err != ErrUnsupported {
+		t.Fatalf("unknown SITE command: %v, want ErrUnsupported", err)
+	}
+	if _, err := NewConn(newFakeConn(nil)).Site("UMASK 022"); err != ErrUnsupported {
+		t.Fatalf("Site without Cmd: %v, want ErrUnsupported", err)
+	}
+}
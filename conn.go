@@ -0,0 +1,336 @@
+package ftpfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goftp/ftp"
+)
+
+// Conn is a logged in FTP connection, the FTP client used by FS.
+// *ftp.ServerConn implements it, other implementations allow to use
+// another FTP client, or to test without a FTP server.
+//
+// FS also uses the following methods when a Conn has them. Features
+// built on them return ErrUnsupported, or fall back as documented, with a
+// Conn which has not. *ftp.ServerConn has neither Cmd, GetEntry nor
+// ListLines, and its data streams can not Abort, so those features need
+// another Conn: the one of DialClient, which has all of them but
+// GetEntry, or a wrapper of another FTP client:
+//
+//	// Cmd sends a raw command, e.g. for SITE, MFMT or FEAT.
+//	Cmd(expected int, format string, args ...interface{}) (code int, msg string, err error)
+//	// FileSize issues SIZE.
+//	FileSize(path string) (int64, error)
+//	// GetEntry issues MLST.
+//	GetEntry(path string) (*ftp.Entry, error)
+//	// ListLines returns the raw lines of LIST, for FS.ParseEntry.
+//	ListLines(path string) ([]string, error)
+//	// NameList issues NLST, for FS.ListNames.
+//	NameList(path string) ([]string, error)
+//	// Quit closes the connection, for FS.Close.
+//	Quit() error
+//	// TLSConnectionState reports the TLS state of the control
+//	// connection, as *tls.Conn does, for FS.IsSecure.
+//	TLSConnectionState() (tls.ConnectionState, bool)
+//
+// The data stream returned by RetrFrom may also have an Abort() error
+// method, to abort the transfer with ABOR instead of reading it to the
+// end when it is closed early.
+type Conn interface {
+	List(path string) ([]*ftp.Entry, error)
+	ChangeDir(path string) error
+	CurrentDir() (string, error)
+	RetrFrom(path string, offset uint64) (io.ReadCloser, error)
+}
+
+// The methods below wrap the FTP client for the rest of the package.
+// fs.mu must be held to call them.
+
+// idle suspends the data transfer in progress, if any, so the control
+// connection is free for a new command. It is called before every
+// command.
+func (fs *FS) idle() {
+	fs.touch()
+	if f := fs.active; f != nil {
+		f.suspend()
+		fs.active = nil
+	}
+}
+
+// list issues LIST, again up to fs.ListRetries times while a line of the
+// reply can not be parsed.
+func (fs *FS) list(name string) ([]*ftp.Entry, error) {
+	for i := 0; ; i++ {
+		ls, err := fs.listOnce(name)
+		if !errors.Is(err, errListLine) || i >= fs.ListRetries {
+			return ls, err
+		}
+	}
+}
+
+// relist lists the directory name again, up to fs.ListRetries times, for
+// a listing which was empty although name is a directory. The last
+// listing is returned as is, with "." and "..".
+func (fs *FS) relist(name string) (ls []*ftp.Entry, err error) {
+	for i := 0; i < fs.ListRetries && len(trimDots(ls)) == 0; i++ {
+		ls, err = fs.list(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ls, nil
+}
+
+func (fs *FS) listOnce(name string) ([]*ftp.Entry, error) {
+	fs.idle()
+	fs.debugf("> LIST %s", name)
+	name, err := fs.encode(name)
+	if err != nil {
+		return nil, err
+	}
+	var ls []*ftp.Entry
+	if fs.ListTimeout > 0 {
+		ls, err = fs.listWithin(name, fs.ListTimeout)
+	} else {
+		ls, err = fs.listConn(fs.conn, name)
+	}
+	fs.debugReply(err)
+	fs.decodeEntries(ls)
+	fs.serverTimes(ls)
+	return ls, err
+}
+
+// serverTimes converts the times of ls, read as UTC, from the time zone
+// fs.ServerLocation to UTC.
+func (fs *FS) serverTimes(ls []*ftp.Entry) {
+	if fs.ServerLocation == nil {
+		return
+	}
+	for _, e := range ls {
+		if t := e.Time; !t.IsZero() {
+			e.Time = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(),
+				t.Second(), t.Nanosecond(), fs.ServerLocation).UTC()
+		}
+	}
+}
+
+func (fs *FS) listConn(c Conn, name string) ([]*ftp.Entry, error) {
+	if fs.ParseEntry != nil {
+		return fs.listParsed(c, name)
+	}
+	return c.List(name)
+}
+
+// listWithin lists name, giving up after d. As the FTP client can not be
+// interrupted, the connection is then abandoned to the LIST in progress,
+// and closed once it ends.
+func (fs *FS) listWithin(name string, d time.Duration) ([]*ftp.Entry, error) {
+	type result struct {
+		ls  []*ftp.Entry
+		err error
+	}
+	c := make(chan result, 1)
+	conn := fs.conn
+	go func() {
+		ls, err := fs.listConn(conn, name)
+		c <- result{ls, err}
+	}()
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case r := <-c:
+		return r.ls, r.err
+	case <-t.C:
+	}
+
+	fs.conn = brokenConn{}
+	go func() {
+		<-c
+		if q, ok := conn.(quitter); ok {
+			q.Quit()
+		}
+	}()
+	return nil, os.ErrDeadlineExceeded
+}
+
+// brokenConn replaces a connection abandoned in an unknown state. Every
+// command fails with net.ErrClosed, which FS.Reconnect recovers from.
+type brokenConn struct{}
+
+func (brokenConn) List(string) ([]*ftp.Entry, error)              { return nil, net.ErrClosed }
+func (brokenConn) ChangeDir(string) error                         { return net.ErrClosed }
+func (brokenConn) CurrentDir() (string, error)                    { return "", net.ErrClosed }
+func (brokenConn) RetrFrom(string, uint64) (io.ReadCloser, error) { return nil, net.ErrClosed }
+func (brokenConn) Quit() error                                    { return nil }
+
+func (brokenConn) Cmd(int, string, ...interface{}) (int, string, error) {
+	return 0, "", net.ErrClosed
+}
+
+func (fs *FS) changeDir(name string) error {
+	fs.idle()
+	fs.debugf("> CWD %s", name)
+	name, err := fs.encode(name)
+	if err != nil {
+		return err
+	}
+	err = fs.conn.ChangeDir(name)
+	fs.debugReply(err)
+	if err == nil {
+		fs.cwd = ""
+	}
+	return err
+}
+
+// probeDir checks name is a directory by changing to it, and returns
+// ErrNotFound if the server refuses to. Other errors, e.g. of the
+// connection, are returned as is. The working directory is restored
+// afterwards.
+func (fs *FS) probeDir(name string) error {
+	dir, err := fs.currentDir()
+	if err != nil {
+		return err
+	}
+	if err := fs.changeDir(name); err != nil {
+		if c := replyCode(err); c >= 500 && c < 600 {
+			return ErrNotFound
+		}
+		return err
+	}
+	if err := fs.changeDir(dir); err != nil {
+		return err
+	}
+	fs.cwd = dir
+	return nil
+}
+
+// currentDir returns the working directory, asking with PWD only after
+// it may have changed.
+func (fs *FS) currentDir() (string, error) {
+	if fs.cwd != "" {
+		return fs.cwd, nil
+	}
+	fs.idle()
+	fs.debugf("> PWD")
+	dir, err := fs.conn.CurrentDir()
+	fs.debugReply(err)
+	if err != nil {
+		return "", err
+	}
+	dir = fs.decode(dir)
+	fs.cwd = dir
+	return dir, nil
+}
+
+func (fs *FS) retrFrom(name string, offset uint64) (io.ReadCloser, error) {
+	fs.idle()
+	if offset > 0 {
+		fs.debugf("> REST %d", offset)
+	}
+	fs.debugf("> RETR %s", name)
+	name, err := fs.encode(name)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := fs.conn.RetrFrom(name, offset)
+	fs.debugReply(err)
+	return rc, err
+}
+
+// nameLister is implemented by FTP clients which support NLST.
+type nameLister interface {
+	NameList(path string) ([]string, error)
+}
+
+func (fs *FS) nameList(nl nameLister, name string) ([]string, error) {
+	fs.idle()
+	fs.debugf("> NLST %s", name)
+	name, err := fs.encode(name)
+	if err != nil {
+		return nil, err
+	}
+	names, err := nl.NameList(name)
+	fs.debugReply(err)
+	for i, n := range names {
+		names[i] = fs.decode(n)
+	}
+	return names, err
+}
+
+// sizer is implemented by FTP clients which support the SIZE command.
+type sizer interface {
+	FileSize(path string) (int64, error)
+}
+
+// fileSize returns the size of name with SIZE. Once the server says it
+// does not implement SIZE, it returns ErrUnsupported without asking.
+// Callers keep the size LIST gave when it fails.
+func (fs *FS) fileSize(name string) (int64, error) {
+	if fs.noSize {
+		return 0, ErrUnsupported
+	}
+	n, err := fs.sizeOnce(name)
+	if err == ErrUnsupported || notImplemented(replyCode(err)) {
+		fs.noSize = true
+		err = ErrUnsupported
+	}
+	return n, err
+}
+
+func (fs *FS) sizeOnce(name string) (int64, error) {
+	fs.idle()
+	s, ok := fs.conn.(sizer)
+	if !ok {
+		_, msg, err := fs.cmd(213, "SIZE %s", name)
+		if err != nil {
+			return 0, err
+		}
+		return strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+	}
+	fs.debugf("> SIZE %s", name)
+	name, err := fs.encode(name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := s.FileSize(name)
+	fs.debugReply(err)
+	return n, err
+}
+
+// touch records the connection is used now, see LastUsed.
+func (fs *FS) touch() {
+	fs.lastUsed.Store(time.Now().UnixNano())
+}
+
+// quitter is implemented by FTP clients which can close the connection.
+type quitter interface {
+	Quit() error
+}
+
+// debugf writes a line to the debug writer of fs, if any.
+func (fs *FS) debugf(format string, args ...interface{}) {
+	if fs.cfg.Debug == nil {
+		return
+	}
+	fmt.Fprintf(fs.cfg.Debug, format+"\n", args...)
+}
+
+// debugReply writes the reply of a command wrapped by the FTP client.
+func (fs *FS) debugReply(err error) {
+	switch te, ok := err.(*textproto.Error); {
+	case err == nil:
+		fs.debugf("< ok")
+	case ok:
+		fs.debugf("< %d %s", te.Code, te.Msg)
+	default:
+		fs.debugf("< error: %v", err)
+	}
+}
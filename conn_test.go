@@ -0,0 +1,386 @@
+package ftpfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goftp/ftp"
+)
+
+// fakeTime is the time of the entries of a fakeConn.
+var fakeTime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// fakeConn is a Conn serving files from memory, for tests without a FTP
+// server. The commands it gets are recorded in sent as they would be sent
+// to a server, e.g. "LIST /d", or "REST 5" and "RETR /d/f".
+type fakeConn struct {
+	dirs  map[string][]*ftp.Entry // listing of each directory
+	files map[string]string       // content of each file
+	cwd   string
+	sent  []string
+}
+
+// newFakeConn returns a fakeConn serving files, keyed by absolute path,
+// in the directories of their paths. A path ending in "/" is an empty
+// directory. Entries have the time fakeTime.
+func newFakeConn(files map[string]string) *fakeConn {
+	c := &fakeConn{
+		dirs:  map[string][]*ftp.Entry{"/": nil},
+		files: make(map[string]string),
+		cwd:   "/",
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if strings.HasSuffix(name, "/") {
+			c.mkdir(path.Clean(name))
+			continue
+		}
+		c.files[name] = files[name]
+		dir := path.Dir(name)
+		c.mkdir(dir)
+		c.dirs[dir] = append(c.dirs[dir], &ftp.Entry{
+			Name: path.Base(name),
+			Type: ftp.EntryTypeFile,
+			Size: uint64(len(files[name])),
+			Time: fakeTime,
+		})
+	}
+	return c
+}
+
+func (c *fakeConn) mkdir(name string) {
+	if _, ok := c.dirs[name]; ok {
+		return
+	}
+	c.dirs[name] = nil
+	dir := path.Dir(name)
+	c.mkdir(dir)
+	c.dirs[dir] = append(c.dirs[dir], &ftp.Entry{
+		Name: path.Base(name),
+		Type: ftp.EntryTypeFolder,
+		Time: fakeTime,
+	})
+}
+
+// entry returns the entry of name in the listing of its directory, for
+// tests to change it, or nil.
+func (c *fakeConn) entry(name string) *ftp.Entry {
+	for _, e := range c.dirs[path.Dir(name)] {
+		if e.Name == path.Base(name) {
+			return e
+		}
+	}
+	return nil
+}
+
+// count returns how many commands of verb, e.g. "RETR", were sent.
+func (c *fakeConn) count(verb string) int {
+	n := 0
+	for _, cmd := range c.sent {
+		if cmd == verb || strings.HasPrefix(cmd, verb+" ") {
+			n++
+		}
+	}
+	return n
+}
+
+func (c *fakeConn) abs(name string) string {
+	if path.IsAbs(name) {
+		return path.Clean(name)
+	}
+	return path.Join(c.cwd, name)
+}
+
+// List lists a directory, or a file as its entry in its directory, like
+// ls. It lists nothing for a missing name, as many servers do.
+func (c *fakeConn) List(name string) ([]*ftp.Entry, error) {
+	c.sent = append(c.sent, "LIST "+name)
+	name = c.abs(name)
+	ls, ok := c.dirs[name]
+	if !ok {
+		if e := c.entry(name); e != nil {
+			ls = []*ftp.Entry{e}
+		}
+	}
+	// FS may change the entries it gets
+	b := make([]*ftp.Entry, len(ls))
+	for i, e := range ls {
+		v := *e
+		b[i] = &v
+	}
+	return b, nil
+}
+
+func (c *fakeConn) ChangeDir(name string) error {
+	c.sent = append(c.sent, "CWD "+name)
+	name = c.abs(name)
+	if _, ok := c.dirs[name]; !ok {
+		return &textproto.Error{Code: 550, Msg: "No such directory"}
+	}
+	c.cwd = name
+	return nil
+}
+
+func (c *fakeConn) CurrentDir() (string, error) {
+	c.sent = append(c.sent, "PWD")
+	return c.cwd, nil
+}
+
+func (c *fakeConn) RetrFrom(name string, offset uint64) (io.ReadCloser, error) {
+	if offset > 0 {
+		c.sent = append(c.sent, fmt.Sprintf("REST %d", offset))
+	}
+	c.sent = append(c.sent, "RETR "+name)
+	s, ok := c.files[c.abs(name)]
+	if !ok {
+		return nil, &textproto.Error{Code: 550, Msg: "No such file"}
+	}
+	if offset > uint64(len(s)) {
+		offset = uint64(len(s))
+	}
+	return io.NopCloser(strings.NewReader(s[offset:])), nil
+}
+
+// sizeConn is a fakeConn which answers SIZE, see sizer.
+type sizeConn struct {
+	*fakeConn
+}
+
+func (c sizeConn) FileSize(name string) (int64, error) {
+	c.sent = append(c.sent, "SIZE "+name)
+	s, ok := c.files[c.abs(name)]
+	if !ok {
+		return 0, &textproto.Error{Code: 550, Msg: "No such file"}
+	}
+	return int64(len(s)), nil
+}
+
+// cmdConn is a fakeConn which can send raw commands, see cmder. A command
+// is answered with its reply in replies, as "code message", or with 502
+// if it has none. A multi-line message is separated by "\n".
+type cmdConn struct {
+	*fakeConn
+	replies map[string]string
+}
+
+func (c cmdConn) Cmd(expected int, format string, args ...interface{}) (int, string, error) {
+	line := fmt.Sprintf(format, args...)
+	c.sent = append(c.sent, line)
+	reply, ok := c.replies[line]
+	if !ok {
+		reply = "502 Command not implemented"
+	}
+	code, _ := strconv.Atoi(reply[:3])
+	msg := strings.TrimPrefix(reply[3:], " ")
+	// as textproto.Reader.ReadResponse
+	switch {
+	case expected < 10 && code/100 == expected,
+		expected < 100 && code/10 == expected,
+		code == expected:
+		return code, msg, nil
+	}
+	return code, msg, &textproto.Error{Code: code, Msg: msg}
+}
+
+func TestNewConn(t *testing.T) {
+	c := newFakeConn(map[string]string{"/d/a.txt": "hello", "/d/e/": ""})
+	fs := NewConn(c)
+
+	f, err := fs.Open("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := f.Readdir(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fi) != 2 || fi[0].Name() != "a.txt" || fi[1].Name() != "e" || !fi[1].IsDir() {
+		t.Fatalf("Readdir = %v", fi)
+	}
+
+	f, err = fs.Open("/d/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Fatalf("read %q, want %q", b, "hello")
+	}
+	f.Close()
+
+	if _, err := fs.Open("/d/missing"); err != ErrNotFound {
+		t.Fatalf("Open of a missing file: %v, want ErrNotFound", err)
+	}
+	want := []string{"LIST /d", "LIST /d/a.txt", "RETR /d/a.txt"}
+	if got := c.sent[:3]; strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("sent %q, want %q", got, want)
+	}
+}
+
+func TestProbeDirRestoresCWD(t *testing.T) {
+	c := newFakeConn(map[string]string{"/d/a.txt": "a", "/d/empty/": ""})
+	fs := NewConn(c)
+	if err := fs.ChangeDir("/d"); err != nil {
+		t.Fatal(err)
+	}
+	// an empty listing is probed with CWD
+	if _, err := fs.Open("/d/empty"); err != nil {
+		t.Fatal(err)
+	}
+	if c.count("CWD /d/empty") != 1 || c.cwd != "/d" {
+		t.Fatalf("sent %q, left in %s; want a probe of /d/empty back to /d", c.sent, c.cwd)
+	}
+	f, err := fs.Open("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(f); err != nil || string(b) != "a" {
+		t.Fatalf("read %q, %v; want %q", b, err, "a")
+	}
+}
+
+// errConn is a fakeConn whose LIST or CWD fail with listErr or cwdErr.
+type errConn struct {
+	*fakeConn
+	listErr, cwdErr error
+}
+
+func (c errConn) List(name string) ([]*ftp.Entry, error) {
+	if c.listErr != nil {
+		c.sent = append(c.sent, "LIST "+name)
+		return nil, c.listErr
+	}
+	return c.fakeConn.List(name)
+}
+
+func (c errConn) ChangeDir(name string) error {
+	if c.cwdErr != nil {
+		c.sent = append(c.sent, "CWD "+name)
+		return c.cwdErr
+	}
+	return c.fakeConn.ChangeDir(name)
+}
+
+func TestEmptyDirOrError(t *testing.T) {
+	files := map[string]string{"/empty/": ""}
+	aborted := &textproto.Error{Code: 451, Msg: "Requested action aborted"}
+	closed := io.ErrUnexpectedEOF
+	for _, tt := range []struct {
+		name    string
+		conn    Conn
+		wantErr error
+	}{
+		{"/empty", newFakeConn(files), nil},
+		{"/missing", newFakeConn(files), ErrNotFound},
+		{"/empty", errConn{newFakeConn(files), aborted, nil}, aborted},
+		{"/empty", errConn{newFakeConn(files), nil, closed}, closed},
+	} {
+		f, err := NewConn(tt.conn).Open(tt.name)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("Open(%q): %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if fi, err := f.Readdir(0); err != nil || len(fi) != 0 {
+			t.Errorf("Readdir(%q) = %v, %v; want an empty directory", tt.name, fi, err)
+		}
+	}
+}
+
+// slowListConn is a quitConn whose LIST hangs until release is closed.
+type slowListConn struct {
+	quitConn
+	release chan struct{}
+}
+
+func (c slowListConn) List(name string) ([]*ftp.Entry, error) {
+	<-c.release
+	return c.fakeConn.List(name)
+}
+
+func TestListTimeout(t *testing.T) {
+	files := map[string]string{"/d/a.txt": "a"}
+	c := slowListConn{quitConn{newFakeConn(files), make(chan struct{})}, make(chan struct{})}
+	dials := 0
+	cfg := Config{Dial: func(string, *Config) (Conn, error) {
+		dials++
+		if dials == 1 {
+			return c, nil
+		}
+		return newFakeConn(files), nil
+	}}
+	fs, err := DialWithConfig("ftp.example.com:21", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.ListTimeout = 50 * time.Millisecond
+	start := time.Now()
+	if _, err := fs.Open("/d"); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Open with a hanging LIST: %v, want os.ErrDeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("Open returned after %v", d)
+	}
+	// the connection in an unknown state is not used again
+	if _, err := fs.Open("/d"); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Open after the timeout: %v, want net.ErrClosed", err)
+	}
+	close(c.release)
+	select {
+	case <-c.quit:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the abandoned connection is not closed")
+	}
+
+	fs.Reconnect = true
+	if _, err := fs.Open("/d"); err != nil || dials != 2 {
+		t.Fatalf("Open with Reconnect: %v after %d dials", err, dials)
+	}
+}
+
+func TestServerLocation(t *testing.T) {
+	files := map[string]string{"/d/a.txt": "a"}
+	modTime := func(fs *FS) time.Time {
+		t.Helper()
+		fi, err := fs.Stat("/d/a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.ModTime()
+	}
+	if mt := modTime(NewConn(newFakeConn(files))); !mt.Equal(fakeTime) {
+		t.Fatalf("ModTime %v by default, want %v as UTC", mt, fakeTime)
+	}
+
+	fs := NewConn(newFakeConn(files))
+	fs.ServerLocation = time.FixedZone("UTC+8", 8*60*60)
+	if mt, want := modTime(fs), fakeTime.Add(-8*time.Hour); !mt.Equal(want) || mt.Location() != time.UTC {
+		t.Fatalf("ModTime %v with a server in UTC+8, want %v", mt, want)
+	}
+
+	// MLST times are UTC already
+	fs = NewConn(mlstConn(files, map[string]string{"/d/a.txt": "type=file;size=1;modify=20200102030405"}))
+	fs.ServerLocation = time.FixedZone("UTC+8", 8*60*60)
+	if mt := modTime(fs); !mt.Equal(fakeTime) {
+		t.Fatalf("ModTime %v of MLST, want %v", mt, fakeTime)
+	}
+}
@@ -0,0 +1,397 @@
+package ftpfs
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/goftp/ftp"
+)
+
+// Config configures the connection made by DialWithConfig.
+// The zero value, apart from the credentials, behaves like Dial.
+type Config struct {
+	// User and Password are used to log in.
+	User     string
+	Password string
+
+	// Account is sent with ACCT if the server asks for it at login, with
+	// a 332 reply. Most servers do not. Sending it needs a connection with
+	// Cmd, see Dial; otherwise such a login fails.
+	Account string
+
+	// Name is copied to FS.Name.
+	Name string
+
+	// Timeout bounds establishing the connection.
+	// Zero means no timeout.
+	Timeout time.Duration
+
+	// Dial, if not nil, is used instead of ftp.DialTimeout to connect,
+	// with this Config. Options of the FTP client which ftpfs does not
+	// wrap, such as a custom dialer or passive mode, are set here, as
+	// well as the fields below which ftp.DialTimeout can not apply.
+	//
+	// The connection is logged in with its Login(user, password string)
+	// error method, as of *ftp.ServerConn; without one it is taken as
+	// logged in already. Account, TransferType, EPSVAll and a TLSConfig
+	// with protected data send raw commands, which needs the Cmd method
+	// described at Conn. *ftp.ServerConn has none, so Dial must return
+	// another client, as DialClient does, or a wrapper able to send them,
+	// for these options.
+	Dial func(addr string, cfg *Config) (Conn, error)
+
+	// TLSConfig, if not nil, is the TLS configuration of the control
+	// connection. As ftp.DialTimeout does not support TLS, Dial must be
+	// set to make the TLS connection with it, e.g. to DialClient.
+	TLSConfig *tls.Config
+
+	// ClearData sends PROT C instead of PROT P after a TLS login, to keep
+	// data connections in clear text. With a TLS control connection,
+	// PBSZ 0 and PROT are always sent, as without PROT P data connections
+	// are not protected. Dial fails if the FTP client can not send them,
+	// unless ClearData is set; IsDataSecure tells whether data is
+	// protected.
+	ClearData bool
+
+	// ActivePortMin and ActivePortMax, if not zero, are the range of
+	// local ports for data connections in active mode (PORT/EPRT). They
+	// do not apply to passive mode. As ftp.DialTimeout only uses passive
+	// mode, Dial must be set to apply them.
+	ActivePortMin int
+	ActivePortMax int
+
+	// EPSVAll sends EPSV ALL after login, which tells the server data
+	// connections are only opened with EPSV, as needed on IPv6 networks
+	// where PASV can not work. The FTP client must open data connections
+	// with EPSV, as ftp.ServerConn does first. It needs a connection with
+	// Cmd, see Dial; Dial fails otherwise.
+	EPSVAll bool
+
+	// UTF8 asks the server to use UTF-8 file names with OPTS UTF8 ON.
+	// It is ignored if the server does not implement it, or if the
+	// connection can not send it, see Dial.
+	UTF8 bool
+
+	// InitialDir, if not empty, is changed to after login, so relative
+	// names are resolved against it. Dial fails if it does not exist.
+	InitialDir string
+
+	// TransferType is sent with TYPE after login, e.g. "I" for binary or
+	// "A" for ASCII. Empty keeps the server default. It needs a
+	// connection with Cmd, see Dial; Dial fails otherwise.
+	TransferType string
+
+	// Debug, if not nil, receives the control connection conversation:
+	// each command sent, prefixed by "> ", and its reply, prefixed by
+	// "< ". Replies to commands wrapped by the FTP client are reported
+	// by their reply code only.
+	Debug io.Writer
+
+	// DebugPassword writes the PASS argument to Debug instead of ****.
+	DebugPassword bool
+}
+
+var (
+	errTLSDial    = errors.New("ftpfs: Config.TLSConfig requires Config.Dial")
+	errActiveDial = errors.New("ftpfs: Config.ActivePortMin/Max require Config.Dial")
+	errCloneDial  = errors.New("ftpfs: Clone requires a FS made by Dial")
+)
+
+// errNoCmd is returned by Dial for an option which sends a raw command,
+// named by field, when the connection can not send it.
+func errNoCmd(field string) error {
+	return fmt.Errorf("ftpfs: Config.%s requires a Config.Dial connection with Cmd", field)
+}
+
+// dialDefault connects with ftp.DialTimeout, which supports none of the
+// options left to Config.Dial.
+func dialDefault(addr string, cfg *Config) (Conn, error) {
+	switch {
+	case cfg.TLSConfig != nil:
+		return nil, errTLSDial
+	case cfg.ActivePortMin != 0 || cfg.ActivePortMax != 0:
+		return nil, errActiveDial
+	case cfg.TransferType != "":
+		return nil, errNoCmd("TransferType")
+	case cfg.EPSVAll:
+		return nil, errNoCmd("EPSVAll")
+	}
+	sc, err := ftp.DialTimeout(addr, cfg.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// loginer is implemented by FTP clients which log in after connecting,
+// as *ftp.ServerConn.
+type loginer interface {
+	Login(user, password string) error
+}
+
+// Dial connects to the FTP server at addr and logs in as user.
+// addr is "host:port"; an IPv6 host must be enclosed in brackets, as in
+// "[2001:db8::1]:21". See net.JoinHostPort.
+func Dial(addr, user, pass string) (*FS, error) {
+	return DialWithConfig(addr, Config{User: user, Password: pass})
+}
+
+// DialContext is like Dial, but gives up when ctx is done. The context
+// deadline also bounds the connection timeout.
+func DialContext(ctx context.Context, addr, user, pass string) (*FS, error) {
+	return dialContext(ctx, addr, Config{User: user, Password: pass})
+}
+
+func dialContext(ctx context.Context, addr string, cfg Config) (*FS, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		if t := time.Until(dl); cfg.Timeout == 0 || t < cfg.Timeout {
+			cfg.Timeout = t
+		}
+	}
+
+	// the FTP client can not be interrupted, leave it to finish alone
+	type result struct {
+		fs  *FS
+		err error
+	}
+	c := make(chan result, 1)
+	go func() {
+		fs, err := DialWithConfig(addr, cfg)
+		c <- result{fs, err}
+	}()
+	select {
+	case r := <-c:
+		return r.fs, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-c; r.fs != nil {
+				r.fs.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// DialWithConfig connects to the FTP server at addr and logs in as
+// configured by cfg. Errors wrap ErrConnect if the server cannot be
+// reached, and ErrAuth if it rejects the login.
+func DialWithConfig(addr string, cfg Config) (*FS, error) {
+	fs := &FS{addr: addr, cfg: cfg}
+	fs.Name = cfg.Name
+	if err := fs.connect(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// connect connects to fs.addr and logs in as configured by fs.cfg. fs.mu
+// must be held once fs is shared.
+func (fs *FS) connect() error {
+	cfg := fs.cfg
+	dial := cfg.Dial
+	if dial == nil {
+		dial = dialDefault
+	}
+	fs.touch()
+	fs.debugf("> CONNECT %s", fs.addr)
+	sc, err := dial(fs.addr, &cfg)
+	fs.debugReply(err)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrConnect, err)
+	}
+	fs.conn = sc
+
+	if err := fs.login(); err != nil {
+		fs.quit()
+		return fmt.Errorf("%w: %w", ErrAuth, err)
+	}
+	if err := fs.setup(); err != nil {
+		fs.quit()
+		return err
+	}
+	return nil
+}
+
+// login logs fs.conn in as fs.cfg.User, if it needs to.
+func (fs *FS) login() error {
+	l, ok := fs.conn.(loginer)
+	if !ok {
+		return nil
+	}
+	cfg := fs.cfg
+	pass := "****"
+	if cfg.DebugPassword {
+		pass = cfg.Password
+	}
+	fs.debugf("> USER %s", cfg.User)
+	fs.debugf("> PASS %s", pass)
+	err := l.Login(cfg.User, cfg.Password)
+	fs.debugReply(err)
+	if replyCode(err) == 332 && cfg.Account != "" {
+		if !fs.canCmd() {
+			return errNoCmd("Account")
+		}
+		_, _, err = fs.cmd(230, "ACCT %s", cfg.Account)
+	}
+	return err
+}
+
+// quit closes fs.conn after a failed login or setup.
+func (fs *FS) quit() {
+	if q, ok := fs.conn.(quitter); ok {
+		q.Quit()
+	}
+}
+
+// Clone dials a new connection with the address and Config fs was made
+// with, and returns it as a FS with the same Options, set before it logs
+// in. The clone is independent: it has its own working directory, which
+// starts where the login puts it, and its own TotalRateLimit. Clone
+// returns an error for a FS made by New or NewConn.
+func (fs *FS) Clone() (*FS, error) {
+	fs.mu.Lock()
+	addr, cfg, opts := fs.addr, fs.cfg, fs.Options
+	fs.mu.Unlock()
+	if addr == "" {
+		return nil, errCloneDial
+	}
+	// the options apply to the login already, e.g. Charset to InitialDir
+	c := &FS{Options: opts, addr: addr, cfg: cfg}
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reconnect replaces the broken connection of fs with a new one, for
+// FS.Reconnect. The state of the old session is forgotten.
+func (fs *FS) reconnect() error {
+	old := fs.conn
+	fs.active = nil
+	fs.cwd = ""
+	fs.feat = nil
+	fs.help = nil
+	if err := fs.connect(); err != nil {
+		fs.conn = old
+		return err
+	}
+	if q, ok := old.(quitter); ok {
+		// the connection is broken, do not wait for it
+		go q.Quit()
+	}
+	return nil
+}
+
+// connError reports whether err means the control connection is broken,
+// rather than a reply to the command: the connection was closed or
+// failed, or the server replied 421 before closing it.
+func connError(err error) bool {
+	var ne net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) || errors.As(err, &ne) ||
+		replyCode(err) == 421
+}
+
+// setup applies the per-session settings of fs.cfg after login.
+func (fs *FS) setup() error {
+	if fs.cfg.TLSConfig != nil {
+		if err := fs.protect(); err != nil {
+			return err
+		}
+	}
+	if fs.cfg.EPSVAll {
+		if !fs.canCmd() {
+			return errNoCmd("EPSVAll")
+		}
+		if _, _, err := fs.cmd(2, "EPSV ALL"); err != nil {
+			return err
+		}
+	}
+	if fs.cfg.UTF8 {
+		_, _, err := fs.cmd(200, "OPTS UTF8 ON")
+		if err != nil && err != ErrUnsupported {
+			return err
+		}
+	}
+	if fs.cfg.TransferType != "" {
+		if !fs.canCmd() {
+			return errNoCmd("TransferType")
+		}
+		_, _, err := fs.cmd(200, "TYPE %s", fs.cfg.TransferType)
+		if err != nil {
+			return err
+		}
+	}
+	if fs.cfg.InitialDir != "" {
+		// the login directory stays the home of FS.HomeRoot
+		if _, err := fs.homeDir(); err != nil {
+			return err
+		}
+		if err := fs.changeDir(fs.cfg.InitialDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// protect sends PBSZ and PROT for the data connections of a TLS session.
+// Data in clear text is only accepted with ClearData.
+func (fs *FS) protect() error {
+	if !fs.canCmd() {
+		if fs.cfg.ClearData {
+			// data connections are in clear text without PROT P
+			return nil
+		}
+		return errNoCmd("TLSConfig")
+	}
+	_, _, err := fs.cmd(200, "PBSZ 0")
+	if err != nil {
+		return err
+	}
+	prot := "P"
+	if fs.cfg.ClearData {
+		prot = "C"
+	}
+	if _, _, err := fs.cmd(200, "PROT %s", prot); err != nil {
+		return err
+	}
+	fs.prot = prot == "P"
+	return nil
+}
+
+// tlsStater is implemented by FTP clients which can tell the TLS state of
+// the control connection, as *tls.Conn.
+type tlsStater interface {
+	TLSConnectionState() (tls.ConnectionState, bool)
+}
+
+// IsSecure reports whether the control connection runs over TLS, as told
+// by the Conn with TLSConnectionState, see Conn. It is false with a Conn
+// which can not tell, as *ftp.ServerConn, even if Config.TLSConfig is
+// set.
+func (fs *FS) IsSecure() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	t, ok := fs.conn.(tlsStater)
+	if !ok {
+		return false
+	}
+	state, ok := t.TLSConnectionState()
+	return ok && state.HandshakeComplete
+}
+
+// IsDataSecure reports whether data connections are protected by TLS.
+// Even with a TLS control connection, data connections are in clear text
+// unless the server accepted PROT P.
+func (fs *FS) IsDataSecure() bool {
+	return fs.prot
+}
@@ -0,0 +1,454 @@
+package ftpfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loginConn is a fakeConn which logs in, accepting password only.
+type loginConn struct {
+	*fakeConn
+	password string
+}
+
+func (c loginConn) Login(user, password string) error {
+	c.sent = append(c.sent, "USER "+user, "PASS "+password)
+	if password != c.password {
+		return &textproto.Error{Code: 530, Msg: "Login incorrect"}
+	}
+	return nil
+}
+
+func TestDebug(t *testing.T) {
+	var buf bytes.Buffer
+	cfg := Config{
+		User:     "user",
+		Password: "secret",
+		Debug:    &buf,
+		Dial: func(string, *Config) (Conn, error) {
+			return loginConn{newFakeConn(map[string]string{"/a.txt": "a"}), "secret"}, nil
+		},
+	}
+	fs, err := DialWithConfig("ftp.example.com:21", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Open("/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	log := buf.String()
+	for _, want := range []string{"> USER user\n", "> PASS ****\n", "> LIST /a.txt\n< ok\n"} {
+		if !strings.Contains(log, want) {
+			t.Errorf("debug output %q lacks %q", log, want)
+		}
+	}
+	if strings.Contains(log, "secret") {
+		t.Errorf("debug output %q shows the password", log)
+	}
+}
+
+// tlsConn is a cmdConn whose control connection runs over TLS.
+type tlsConn struct {
+	cmdConn
+}
+
+func (c tlsConn) TLSConnectionState() (tls.ConnectionState, bool) {
+	return tls.ConnectionState{HandshakeComplete: true}, true
+}
+
+func TestIsSecure(t *testing.T) {
+	fs, err := DialWithConfig("ftp.example.com:21", Config{
+		Dial: func(string, *Config) (Conn, error) { return newFakeConn(nil), nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs.IsSecure() || fs.IsDataSecure() {
+		t.Errorf("plain connection: IsSecure() = %t, IsDataSecure() = %t", fs.IsSecure(), fs.IsDataSecure())
+	}
+
+	replies := map[string]string{
+		"PBSZ 0": "200 PBSZ=0",
+		"PROT P": "200 Protection level set to P",
+	}
+	fs, err = DialWithConfig("ftp.example.com:21", Config{
+		TLSConfig: &tls.Config{ServerName: "ftp.example.com"},
+		Dial: func(string, *Config) (Conn, error) {
+			return tlsConn{cmdConn{newFakeConn(nil), replies}}, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fs.IsSecure() || !fs.IsDataSecure() {
+		t.Errorf("TLS connection: IsSecure() = %t, IsDataSecure() = %t", fs.IsSecure(), fs.IsDataSecure())
+	}
+
+	// the configuration alone does not make the connection secure
+	fs, err = DialWithConfig("ftp.example.com:21", Config{
+		TLSConfig: &tls.Config{ServerName: "ftp.example.com"},
+		Dial: func(string, *Config) (Conn, error) {
+			return cmdConn{newFakeConn(nil), replies}, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs.IsSecure() {
+		t.Errorf("IsSecure() = true with a Conn which can not tell")
+	}
+}
+
+// acctConn is a cmdConn which asks for an account at login.
+type acctConn struct {
+	cmdConn
+}
+
+func (c acctConn) Login(user, password string) error {
+	c.sent = append(c.sent, "USER "+user, "PASS "+password)
+	return &textproto.Error{Code: 332, Msg: "Need account for login"}
+}
+
+func TestAccount(t *testing.T) {
+	c := acctConn{cmdConn{newFakeConn(nil), map[string]string{"ACCT dept": "230 User logged in"}}}
+	cfg := Config{
+		User:    "user",
+		Account: "dept",
+		Dial:    func(string, *Config) (Conn, error) { return c, nil },
+	}
+	if _, err := DialWithConfig("ftp.example.com:21", cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(c.sent, "\n"), "USER user\nPASS \nACCT dept"; got != want {
+		t.Fatalf("sent %q, want %q", got, want)
+	}
+
+	cfg.Account = ""
+	if _, err := DialWithConfig("ftp.example.com:21", cfg); !errors.Is(err, ErrAuth) {
+		t.Fatalf("login without the account: %v, want ErrAuth", err)
+	}
+}
+
+func TestActivePorts(t *testing.T) {
+	var got *Config
+	_, err := DialWithConfig("ftp.example.com:21", Config{
+		ActivePortMin: 50000,
+		ActivePortMax: 50100,
+		Dial: func(addr string, cfg *Config) (Conn, error) {
+			got = cfg
+			return newFakeConn(nil), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ActivePortMin != 50000 || got.ActivePortMax != 50100 {
+		t.Fatalf("Dial got ports %d-%d, want 50000-50100", got.ActivePortMin, got.ActivePortMax)
+	}
+
+	_, err = DialWithConfig("ftp.example.com:21", Config{ActivePortMin: 50000, ActivePortMax: 50100})
+	if !errors.Is(err, errActiveDial) {
+		t.Fatalf("ports without Config.Dial: %v, want %v", err, errActiveDial)
+	}
+}
+
+func TestEPSVAll(t *testing.T) {
+	c := cmdConn{newFakeConn(nil), map[string]string{"EPSV ALL": "200 EPSV ALL ok"}}
+	cfg := Config{EPSVAll: true, Dial: func(string, *Config) (Conn, error) { return c, nil }}
+	if _, err := DialWithConfig("[2001:db8::1]:21", cfg); err != nil {
+		t.Fatal(err)
+	}
+	if c.count("EPSV ALL") != 1 {
+		t.Fatalf("sent %q, want EPSV ALL", c.sent)
+	}
+
+	cfg.Dial = func(string, *Config) (Conn, error) { return newFakeConn(nil), nil }
+	if _, err := DialWithConfig("[2001:db8::1]:21", cfg); err == nil {
+		t.Fatal("EPSVAll without Cmd: no error")
+	}
+}
+
+// TestDialIPv6 logs in as anonymous to the FTP server at the address in
+// FTPFS_TEST_IPV6, e.g. "[::1]:21", and lists its root.
+func TestDialIPv6(t *testing.T) {
+	addr := os.Getenv("FTPFS_TEST_IPV6")
+	if addr == "" {
+		t.Skip("FTPFS_TEST_IPV6 is not set")
+	}
+	fs, err := Dial(addr, "anonymous", "anonymous")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if _, err := fs.Open("/"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// quitConn is a fakeConn which reports its Quit on quit.
+type quitConn struct {
+	*fakeConn
+	quit chan struct{}
+}
+
+func (c quitConn) Quit() error {
+	close(c.quit)
+	return nil
+}
+
+func TestDialContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dialed := false
+	cfg := Config{Dial: func(string, *Config) (Conn, error) {
+		dialed = true
+		return newFakeConn(nil), nil
+	}}
+	if _, err := dialContext(ctx, "ftp.example.com:21", cfg); err != context.Canceled || dialed {
+		t.Fatalf("dial with a canceled context: %v, dialed %t", err, dialed)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	c := quitConn{newFakeConn(nil), make(chan struct{})}
+	release := make(chan struct{})
+	cfg.Dial = func(string, *Config) (Conn, error) {
+		cancel()
+		<-release
+		return c, nil
+	}
+	if _, err := dialContext(ctx, "ftp.example.com:21", cfg); err != context.Canceled {
+		t.Fatalf("dial canceled meanwhile: %v, want context.Canceled", err)
+	}
+	// the connection made late is closed
+	close(release)
+	select {
+	case <-c.quit:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection made after cancel not closed")
+	}
+}
+
+func TestDialErrors(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	cfg := Config{Dial: func(string, *Config) (Conn, error) { return nil, refused }}
+	_, err := DialWithConfig("ftp.example.com:21", cfg)
+	if !errors.Is(err, ErrConnect) || errors.Is(err, ErrAuth) || !errors.Is(err, refused) {
+		t.Fatalf("dial failure: %v, want ErrConnect wrapping the dial error", err)
+	}
+
+	c := loginConn{newFakeConn(nil), "secret"}
+	cfg = Config{User: "user", Password: "wrong", Dial: func(string, *Config) (Conn, error) { return c, nil }}
+	_, err = DialWithConfig("ftp.example.com:21", cfg)
+	if !errors.Is(err, ErrAuth) || errors.Is(err, ErrConnect) || replyCode(err) != 530 {
+		t.Fatalf("rejected login: %v, want ErrAuth wrapping the 530 reply", err)
+	}
+
+	cfg.Password = "secret"
+	if _, err := DialWithConfig("ftp.example.com:21", cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	files := map[string]string{"/a.txt": "a"}
+	var dials int
+	cfg := Config{Dial: func(string, *Config) (Conn, error) {
+		dials++
+		if dials == 1 {
+			// closed by the server while idle
+			return errConn{newFakeConn(files), io.EOF, io.EOF}, nil
+		}
+		return newFakeConn(files), nil
+	}}
+	fs, err := DialWithConfig("ftp.example.com:21", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Open("/a.txt"); !errors.Is(err, io.EOF) {
+		t.Fatalf("Open on a broken connection without Reconnect: %v, want io.EOF", err)
+	}
+
+	fs.Reconnect = true
+	f, err := fs.Open("/a.txt")
+	if err != nil {
+		t.Fatalf("Open with Reconnect: %v", err)
+	}
+	if b, err := io.ReadAll(f); err != nil || string(b) != "a" {
+		t.Fatalf("read %q, %v; want %q", b, err, "a")
+	}
+	if dials != 2 {
+		t.Fatalf("dialed %d times, want 2", dials)
+	}
+	// replies of the server do not reconnect
+	if _, err := fs.Open("/missing"); err != ErrNotFound || dials != 2 {
+		t.Fatalf("Open of a missing file: %v after %d dials, want ErrNotFound without dialing", err, dials)
+	}
+}
+
+func TestClone(t *testing.T) {
+	var conns []*fakeConn
+	cfg := Config{
+		User:     "user",
+		Password: "secret",
+		Dial: func(string, *Config) (Conn, error) {
+			c := newFakeConn(map[string]string{"/d/a.txt": "a"})
+			conns = append(conns, c)
+			return loginConn{c, "secret"}, nil
+		},
+	}
+	fs, err := DialWithConfig("ftp.example.com:21", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.ReadRetries = 3
+	if err := fs.ChangeDir("/d"); err != nil {
+		t.Fatal(err)
+	}
+	c, err := fs.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conns) != 2 || c.conn == fs.conn {
+		t.Fatalf("Clone dialed %d connections, want a second one", len(conns))
+	}
+	if conns[1].count("PASS secret") != 1 {
+		t.Fatalf("clone sent %q, want a login", conns[1].sent)
+	}
+	if c.ReadRetries != 3 {
+		t.Fatalf("clone ReadRetries %d, want the options of fs", c.ReadRetries)
+	}
+	// the working directory is not shared
+	if _, err := c.Open("a.txt"); err != ErrNotFound {
+		t.Fatalf("Open(a.txt) on the clone: %v, want ErrNotFound out of /d", err)
+	}
+	if _, err := fs.Open("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewConn(newFakeConn(nil)).Clone(); err != errCloneDial {
+		t.Fatalf("Clone of a FS of NewConn: %v, want %v", err, errCloneDial)
+	}
+}
+
+func TestProtect(t *testing.T) {
+	replies := map[string]string{
+		"PBSZ 0": "200 PBSZ=0",
+		"PROT P": "200 Protection level set to P",
+		"PROT C": "200 Protection level set to C",
+	}
+	for _, tt := range []struct {
+		clear bool
+		want  string
+	}{
+		{false, "PBSZ 0\nPROT P"},
+		{true, "PBSZ 0\nPROT C"},
+	} {
+		c := cmdConn{newFakeConn(nil), replies}
+		fs, err := DialWithConfig("ftp.example.com:21", Config{
+			TLSConfig: &tls.Config{ServerName: "ftp.example.com"},
+			ClearData: tt.clear,
+			Dial:      func(string, *Config) (Conn, error) { return c, nil },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(c.sent, "\n"); got != tt.want {
+			t.Errorf("ClearData %t: sent %q, want %q", tt.clear, got, tt.want)
+		}
+		if fs.IsDataSecure() == tt.clear {
+			t.Errorf("ClearData %t: IsDataSecure() = %t", tt.clear, fs.IsDataSecure())
+		}
+	}
+
+	// a server refusing PROT P fails the Dial
+	c := cmdConn{newFakeConn(nil), map[string]string{"PBSZ 0": "200 PBSZ=0", "PROT P": "534 Request denied for policy reasons"}}
+	cfg := Config{
+		TLSConfig: &tls.Config{ServerName: "ftp.example.com"},
+		Dial:      func(string, *Config) (Conn, error) { return c, nil },
+	}
+	if _, err := DialWithConfig("ftp.example.com:21", cfg); replyCode(err) != 534 {
+		t.Fatalf("PROT P refused: %v, want the 534 reply", err)
+	}
+
+	// without Cmd, data in clear text is only accepted with ClearData
+	cfg.Dial = func(string, *Config) (Conn, error) { return newFakeConn(nil), nil }
+	if _, err := DialWithConfig("ftp.example.com:21", cfg); err == nil || err.Error() != errNoCmd("TLSConfig").Error() {
+		t.Fatalf("TLS without Cmd: %v, want %v", err, errNoCmd("TLSConfig"))
+	}
+	cfg.ClearData = true
+	if _, err := DialWithConfig("ftp.example.com:21", cfg); err != nil {
+		t.Fatalf("TLS without Cmd with ClearData: %v", err)
+	}
+}
+
+func TestInitialDir(t *testing.T) {
+	files := map[string]string{"/pub/data/a.txt": "a"}
+	c := newFakeConn(files)
+	cfg := Config{InitialDir: "/pub/data", Dial: func(string, *Config) (Conn, error) { return c, nil }}
+	fs, err := DialWithConfig("ftp.example.com:21", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.cwd != "/pub/data" {
+		t.Fatalf("working directory %s after Dial, want /pub/data", c.cwd)
+	}
+	f, err := fs.Open("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(f); err != nil || string(b) != "a" {
+		t.Fatalf("read %q, %v; want %q", b, err, "a")
+	}
+
+	cfg.InitialDir = "/missing"
+	cfg.Dial = func(string, *Config) (Conn, error) { return newFakeConn(files), nil }
+	if _, err := DialWithConfig("ftp.example.com:21", cfg); replyCode(err) != 550 {
+		t.Fatalf("Dial with a missing InitialDir: %v, want the 550 reply", err)
+	}
+}
+
+func TestDialWithConfig(t *testing.T) {
+	var got *Config
+	cfg := Config{
+		User:    "user",
+		Name:    "mirror",
+		Timeout: 5 * time.Second,
+		UTF8:    true,
+		Dial: func(addr string, cfg *Config) (Conn, error) {
+			if addr != "ftp.example.com:21" {
+				t.Errorf("Dial(%q), want ftp.example.com:21", addr)
+			}
+			got = cfg
+			return newFakeConn(nil), nil
+		},
+	}
+	// UTF8 is ignored by a connection without Cmd, as ftp.ServerConn
+	fs, err := DialWithConfig("ftp.example.com:21", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.User != "user" || got.Timeout != 5*time.Second || !got.UTF8 {
+		t.Fatalf("Dial got %+v, want the Config", got)
+	}
+	if fs.Name != "mirror" {
+		t.Fatalf("Name %q, want Config.Name", fs.Name)
+	}
+
+	for field, cfg := range map[string]Config{
+		"TransferType": {TransferType: "I"},
+		"EPSVAll":      {EPSVAll: true},
+	} {
+		if _, err := DialWithConfig("ftp.example.com:21", cfg); !errors.Is(err, ErrConnect) || !strings.HasSuffix(err.Error(), errNoCmd(field).Error()) {
+			t.Errorf("%s without Config.Dial: %v, want %v", field, err, errNoCmd(field))
+		}
+	}
+}
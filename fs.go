@@ -5,47 +5,748 @@ package ftpfs
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/textproto"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 
 	"github.com/goftp/ftp"
+	"golang.org/x/text/encoding"
 )
 
 // FS is a user logged in, FTP connection.
 // It implements http.FileSystem.
 //
-// As it relays on FTP connection, it is not safe for concurrent use.
-type FS ftp.ServerConn
+// FS is safe for concurrent use, but as it relays on a single FTP
+// connection, commands are serialized and only one file transfers data
+// at a time. When another file reads, or another command is issued, the
+// transfer in progress is suspended and resumes with a new data
+// connection on its next Read. A file itself must not be used
+// concurrently.
+//
+// FS used to be defined as ftp.ServerConn, and made by converting a
+// connection with (*ftpfs.FS)(sc). It is now a struct, so that conversion
+// no longer compiles: use New(sc) instead.
+type FS struct {
+	Options
+
+	bytesRead atomic.Int64
+	lastUsed  atomic.Int64 // UnixNano
+
+	mu     sync.Mutex // serializes use of conn
+	conn   Conn
+	active *File // file which may own the data connection
+	addr   string
+	cfg    Config
+	prot   bool              // data connections are protected, PROT P
+	feat   map[string]string // FEAT reply, nil until requested
+	noMLST bool              // MLST is not supported
+	noSize bool              // SIZE is not supported
+	help   *string           // HELP reply, nil until requested
+
+	totalRate *bucket              // TotalRateLimit, created with the first File
+	cwd       string               // working directory, "" if unknown
+	home      string               // working directory at login, for HomeRoot
+	notFound  map[string]time.Time // NotFoundTTL expiry by path
+
+	caseSensitive *bool // result of CaseSensitive, nil until probed
+}
+
+// Options are the settings of a FS. They are embedded in FS, so they are
+// set as its fields, e.g. fs.ReadRetries = 3, before the FS is shared
+// between goroutines. Clone copies them all.
+type Options struct {
+	// Name identifies the FS in String. It is purely cosmetic.
+	// If empty, String uses the address and user given to Dial.
+	Name string
+
+	// MaxFileSize, if positive, is the largest file Open accepts.
+	// Open returns ErrTooLarge for larger files. Directories are not
+	// affected. As the listed size may be wrong or missing, Read also
+	// returns ErrTooLarge once past MaxFileSize bytes, for OpenAt too.
+	MaxFileSize int64
+
+	// ParseEntry, if not nil, parses each line of LIST output instead of
+	// the FTP client, for servers with a nonstandard format. It may
+	// return ErrUseDefault to parse the line with the default parser, or
+	// a nil entry to skip it. It requires a Conn with a ListLines method
+	// returning the raw LIST lines, which *ftp.ServerConn has not; with
+	// other Conns, every listing returns ErrUnsupported.
+	ParseEntry func(line string) (*ftp.Entry, error)
+
+	// RetryEmpty retries a RETR once if its data connection ends without
+	// any byte, although the file size says there is data left. Some
+	// servers do so on transient failures. Empty files are not retried.
+	RetryEmpty bool
+
+	// SizeFallback makes Open try name as a file with SIZE when LIST
+	// of name fails, for servers which only LIST directories.
+	SizeFallback bool
+
+	// ReadRetries is how many times a Read reopens the data connection
+	// to resume a transfer which failed transiently, e.g. with a 426
+	// reply. Zero means once.
+	ReadRetries int
+
+	// MaxDirEntries, if positive, is the most entries a directory keeps.
+	// The rest of a longer listing is dropped and the directory reports
+	// it with a Truncated() bool method, e.g.
+	//
+	//	t, ok := f.(interface{ Truncated() bool })
+	//	truncated := ok && t.Truncated()
+	//
+	// It only bounds what the directory keeps once listed: the FTP client
+	// still reads the whole listing into memory first, so it does not
+	// protect from a listing too large for memory.
+	MaxDirEntries int
+
+	// ListLimit, if positive, is the most entries the server is thought
+	// to list, for servers which silently cut longer listings. A listing
+	// of exactly ListLimit entries, counting "." and ".." if the server
+	// sends them, is then reported by Truncated() as above, although the
+	// directory may have that many entries only.
+	ListLimit int
+
+	// PreferDir opens the directory when name matches a file and a
+	// directory which differ only by case, and none has the case of
+	// name. By default the file is opened.
+	PreferDir bool
+
+	// ReadTimeout, if positive, bounds each read of a data connection, so
+	// a stalled transfer makes Read fail with os.ErrDeadlineExceeded.
+	ReadTimeout time.Duration
+
+	// RateLimit, if positive, limits in bytes per second how fast each
+	// file is read. TotalRateLimit limits all files together.
+	RateLimit      int64
+	TotalRateLimit int64
+
+	// ListRetries is how many times LIST is issued again for servers
+	// which send a partial listing at times: when a line of it can not be
+	// parsed, or when it is empty but the directory exists. Retrying
+	// stops at the first complete, non-empty listing, so really empty
+	// directories cost ListRetries more LIST. Lines which can not be
+	// parsed are only seen with ParseEntry: *ftp.ServerConn skips them.
+	ListRetries int
+
+	// VerifySize makes a Read which reaches the end of a transfer before
+	// the size of the file, confirmed with SIZE, fail with
+	// ErrShortTransfer instead of io.EOF. Close then returns it too.
+	// Nothing is verified if the server does not answer SIZE.
+	VerifySize bool
+
+	// Reconnect makes Open dial again and retry once when it finds the
+	// control connection broken, e.g. closed by the server while idle.
+	// Replies of the server, such as not found, are not retried. It only
+	// applies to a FS made by Dial or DialWithConfig.
+	Reconnect bool
+
+	// ListTimeout, if positive, bounds each LIST, which may take much
+	// longer than a read on some directories. A LIST which times out
+	// fails with os.ErrDeadlineExceeded, and leaves the connection in an
+	// unknown state: it is closed, and later commands fail until Open
+	// reconnects with Reconnect.
+	ListTimeout time.Duration
+
+	// HomeRoot resolves absolute names against the home directory, the
+	// working directory at login, instead of the root of the server.
+	// E.g. with a home of "/home/user", "/x" is "/home/user/x". By
+	// default "/x" is "/x" on the server, and only relative names are
+	// resolved against the working directory.
+	HomeRoot bool
+
+	// StrictTypeDetection checks with CWD that a name whose LIST shows a
+	// single file of the same name is not a directory containing it,
+	// instead of assuming a file. It costs two or three more commands per
+	// file opened, when the server does not support MLST.
+	StrictTypeDetection bool
+
+	// MaxSymlinkDepth is how many symbolic links EvalSymlinks follows
+	// before it gives up with ErrTooManyLinks. Zero means 40, as Linux.
+	MaxSymlinkDepth int
+
+	// Progress, if not nil, is called after Reads of a file with its path,
+	// the position reached and its size, to report a transfer. It is
+	// called at most every ProgressInterval, or on every Read if zero,
+	// and always when a Read reaches the end.
+	Progress         func(name string, pos, size int64)
+	ProgressInterval time.Duration
+
+	// NotFoundTTL, if positive, is how long Open remembers a name which
+	// was not found, and returns ErrNotFound for it again without asking
+	// the server. Keep it short, as files created on the server in the
+	// meantime are not seen.
+	NotFoundTTL time.Duration
+
+	// Charset, if not nil, is the encoding of file names on the server,
+	// for servers which do not use UTF-8, e.g. simplifiedchinese.GBK of
+	// golang.org/x/text. Names are converted from and to UTF-8.
+	Charset encoding.Encoding
+
+	// ServerLocation, if not nil, is the time zone of the times LIST
+	// shows, which have none, so ModTime is right for servers listing in
+	// their local time. By default they are taken as UTC. Times of MLST
+	// and MDTM are always UTC and are left as is.
+	ServerLocation *time.Location
+}
+
+// New returns a FS using sc, which must be logged in already.
+func New(sc *ftp.ServerConn) *FS {
+	return NewConn(sc)
+}
+
+// NewConn returns a FS using c, which must be logged in already.
+func NewConn(c Conn) *FS {
+	fs := &FS{conn: c}
+	fs.touch()
+	return fs
+}
+
+// Close suspends the transfer in progress, if any, and closes the
+// connection with QUIT. Files opened from fs can not be read afterwards.
+func (fs *FS) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.idle()
+	q, ok := fs.conn.(quitter)
+	if !ok {
+		return nil
+	}
+	fs.debugf("> QUIT")
+	err := q.Quit()
+	fs.debugReply(err)
+	return err
+}
+
+// BytesRead returns the number of bytes retrieved from the server since
+// the FS was created or ResetBytesRead was called. Bytes served again
+// from the buffer of a File are not counted.
+func (fs *FS) BytesRead() int64 {
+	return fs.bytesRead.Load()
+}
+
+// ResetBytesRead sets the counter of BytesRead to zero.
+func (fs *FS) ResetBytesRead() {
+	fs.bytesRead.Store(0)
+}
+
+// LastUsed returns when the connection was last used, by a command or
+// a data transfer. It may be used to close idle connections.
+func (fs *FS) LastUsed() time.Time {
+	return time.Unix(0, fs.lastUsed.Load())
+}
+
+// String returns Name if set, otherwise ftpfs(user@host) derived from
+// the dial address.
+func (fs *FS) String() string {
+	if fs.Name != "" {
+		return fs.Name
+	}
+	host := fs.addr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	switch {
+	case host == "":
+		return "ftpfs"
+	case fs.cfg.User == "":
+		return fmt.Sprintf("ftpfs(%s)", host)
+	}
+	return fmt.Sprintf("ftpfs(%s@%s)", fs.cfg.User, host)
+}
 
 // Open issues a LIST FTP command with name to FTP server.
+//
+// A relative name is resolved against the working directory of the
+// connection at the time of Open, see ChangeDir. The empty name is the
+// working directory, as ".".
 func (fs *FS) Open(name string) (http.File, error) {
-	sc := (*ftp.ServerConn)(fs)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.open(name)
+}
+
+// OpenFile is like Open, but returns the file typed as *File. It returns
+// ErrReadDir if name is a directory.
+func (fs *FS) OpenFile(name string) (*File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	f, err := fs.open(name)
+	if err != nil {
+		return nil, err
+	}
+	file, ok := f.(*File)
+	if !ok {
+		return nil, ErrReadDir
+	}
+	return file, nil
+}
+
+// OpenReadSeeker is like OpenFile, for callers which need the file as an
+// io.ReadSeekCloser.
+func (fs *FS) OpenReadSeeker(name string) (io.ReadSeekCloser, error) {
+	f, err := fs.OpenFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// OpenAt starts retrieving name from offset, without listing it first,
+// and returns the data. Like Files, several readers of the same FS take
+// turns on the connection; for parallel segmented downloads, use a FS
+// for each reader.
+func (fs *FS) OpenAt(name string, offset int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, ErrInvalid
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name, err := fs.abs(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fs.newFile(name, &ftp.Entry{Name: path.Base(name), Type: ftp.EntryTypeFile})
+	if err != nil {
+		return nil, err
+	}
+	f.readCloser, err = fs.retrFrom(name, uint64(offset))
+	if err != nil {
+		return nil, err
+	}
+	fs.active = f
+	f.next = uint64(offset)
+	f.offset = f.next
+	f.start = f.next
+	f.bufStart = f.next
+	return f, nil
+}
+
+// OpenType is like Open, but also reports whether name is a directory,
+// as determined while opening it.
+func (fs *FS) OpenType(name string) (f http.File, isDir bool, err error) {
+	f, err = fs.Open(name)
+	if err != nil {
+		return nil, false, err
+	}
+	_, isDir = f.(*ftpDir)
+	return f, isDir, nil
+}
+
+// OpenStat is like Open, but also returns the FileInfo of name, from the
+// same lookup. It saves the second LIST of a Stat followed by an Open.
+func (fs *FS) OpenStat(name string) (http.File, os.FileInfo, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, fi, nil
+}
 
-	ls, err := sc.List(name)
+// Stat returns the FileInfo of name. It issues a single MLST if the
+// server supports it, whose facts are authoritative; otherwise name is
+// listed as by Open. MLST is only issued with a Conn which has GetEntry
+// or Cmd, which *ftp.ServerConn has not. Without MLST, a directory is
+// also looked up in its parent, so both ways give its base name and
+// time.
+func (fs *FS) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dirOnly := len(name) > 1 && strings.HasSuffix(name, "/")
+	abs := name
+	if dirOnly {
+		abs = strings.TrimRight(abs, "/")
+		if abs == "" {
+			abs = "/"
+		}
+	}
+	abs, err := fs.abs(abs)
+	if err != nil {
+		return nil, err
+	}
+	if fs.cachedNotFound(abs) {
+		return nil, ErrNotFound
+	}
+	switch e, err := fs.mlst(abs); {
+	case err == nil && !e.typed:
+		// a link or a type of its own, opened to tell what it is
+	case err == nil:
+		if dirOnly && !e.IsDir() {
+			return nil, ErrNotFound
+		}
+		return e, nil
+	case replyCode(err) == 550:
+		fs.cacheNotFound(abs)
+		return nil, ErrNotFound
+	case err != ErrUnsupported:
+		return nil, err
+	}
+
+	f, err := fs.open(name)
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := f.(*ftpDir); ok {
+		return fs.dirInfo(d), nil
+	}
+	// f has no data connection yet, nothing to close
+	return f.Stat()
+}
+
+// dirInfo returns the entry of the directory d in the listing of its
+// parent, which has its time as MLST would. d itself is returned for the
+// root, or if the parent can not be listed.
+func (fs *FS) dirInfo(d *ftpDir) os.FileInfo {
+	if d.path == "/" {
+		return d
+	}
+	ls, err := fs.list(path.Dir(d.path))
+	if err != nil {
+		return d
+	}
+	for _, e := range ls {
+		if e.Name == d.Name() && isDir(e) {
+			return ftpEntry{Entry: e}
+		}
+	}
+	return d
+}
+
+// open implements Open with fs.mu held.
+func (fs *FS) open(name string) (http.File, error) {
+	f, l, err := fs.find(name)
 	if err != nil {
 		return nil, err
 	}
+	if l != nil {
+		return fs.newDir(l.name, l.entries, l.listed), nil
+	}
+	return f, nil
+}
+
+// listing is the listing of a directory found by lookup, which newDir
+// makes the directory of.
+type listing struct {
+	name    string
+	entries []*ftp.Entry
+	listed  int
+}
+
+// find looks name up as Open does, and returns either the file or the
+// listing of the directory.
+func (fs *FS) find(name string) (*File, *listing, error) {
+	f, l, err := fs.findOnce(name)
+	if err != nil && fs.Reconnect && fs.addr != "" && connError(err) {
+		if rerr := fs.reconnect(); rerr != nil {
+			return nil, nil, rerr
+		}
+		return fs.findOnce(name)
+	}
+	return f, l, err
+}
+
+func (fs *FS) findOnce(name string) (*File, *listing, error) {
+	if name == "" {
+		name = "."
+	}
+	// "/dir/" and "/dir" may LIST differently, always list without the
+	// slash, but only accept a directory for it
+	dirOnly := false
+	if len(name) > 1 && strings.HasSuffix(name, "/") {
+		name = strings.TrimRight(name, "/")
+		if name == "" {
+			name = "/"
+		}
+		dirOnly = true
+	}
+	name, err := fs.abs(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fs.cachedNotFound(name) {
+		return nil, nil, ErrNotFound
+	}
+	f, l, err := fs.lookup(name, dirOnly)
+	switch err {
+	case ErrNotFound:
+		fs.cacheNotFound(name)
+	case errNotDir:
+		// name exists, as a file: it is only not found with the slash
+		err = ErrNotFound
+	}
+	return f, l, err
+}
+
+// errNotDir is returned by lookup for a file asked as a directory.
+var errNotDir = errors.New("not a directory")
+
+// cachedNotFound reports whether name was not found less than
+// fs.NotFoundTTL ago.
+func (fs *FS) cachedNotFound(name string) bool {
+	t, ok := fs.notFound[name]
+	if ok && time.Now().After(t) {
+		delete(fs.notFound, name)
+		return false
+	}
+	return ok
+}
+
+// cacheNotFound remembers name was not found, for fs.NotFoundTTL.
+func (fs *FS) cacheNotFound(name string) {
+	if fs.NotFoundTTL <= 0 {
+		return
+	}
+	now := time.Now()
+	if fs.notFound == nil {
+		fs.notFound = make(map[string]time.Time)
+	} else if len(fs.notFound) >= 256 {
+		// do not grow with names which are not asked again
+		for n, t := range fs.notFound {
+			if now.After(t) {
+				delete(fs.notFound, n)
+			}
+		}
+	}
+	fs.notFound[name] = now.Add(fs.NotFoundTTL)
+}
+
+// lookup finds the absolute name, a directory only if dirOnly: a file is
+// errNotDir then. It returns the file, or the listing of the directory.
+func (fs *FS) lookup(name string, dirOnly bool) (*File, *listing, error) {
+	// MLST tells file from directory for sure, when supported
+	switch e, err := fs.mlst(name); {
+	case err == nil && !e.typed:
+		// a link or a type of its own: LIST and CWD tell what it leads
+		// to, as without MLST
+	case err == nil && !e.IsDir():
+		if dirOnly {
+			return nil, nil, errNotDir
+		}
+		f, err := fs.newFile(name, e.Entry)
+		if err != nil {
+			return nil, nil, err
+		}
+		f.entry = e
+		f.sized = true
+		return f, nil, nil
+	case err == nil:
+		ls, err := fs.list(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, &listing{name, ls, len(ls)}, nil
+	case replyCode(err) == 550:
+		return nil, nil, ErrNotFound
+	case err != ErrUnsupported:
+		return nil, nil, err
+	}
+
+	raw, err := fs.list(name)
+	if err != nil {
+		if fs.SizeFallback && !dirOnly {
+			// the server may not LIST files, try it as a file
+			if n, serr := fs.fileSize(name); serr == nil {
+				f, err := fs.newFile(name, &ftp.Entry{
+					Name: path.Base(name),
+					Type: ftp.EntryTypeFile,
+					Size: uint64(n),
+				})
+				if err != nil {
+					return nil, nil, err
+				}
+				f.sized = true
+				return f, nil, nil
+			}
+		}
+		return nil, nil, err
+	}
+	ls := trimDots(raw)
 	if len(ls) == 0 {
 		// check if it really contains no files
-		err := sc.ChangeDir(name)
+		if err := fs.probeDir(name); err != nil {
+			return nil, nil, err
+		}
+		if raw, err = fs.relist(name); err != nil {
+			return nil, nil, err
+		}
+		ls = trimDots(raw)
+	}
+
+	if len(ls) == 1 && !isDir(ls[0]) && !nameMatch(name, ls[0].Name) &&
+		strings.EqualFold(path.Base(name), ls[0].Name) {
+		// a case insensitive server may list the file, or a directory
+		// containing a file of the same name
+		e, err := fs.pickCase(name)
 		if err != nil {
-			return nil, ErrNotFound
+			return nil, nil, err
 		}
+		if isDir(e) {
+			return nil, &listing{name, ls, len(raw)}, nil
+		}
+		ls = []*ftp.Entry{e}
 	}
 
-	if len(ls) == 1 && !isDir(ls[0]) && nameMatch(name, ls[0].Name) {
+	if len(ls) == 1 && !isDir(ls[0]) && nameMatchFold(name, ls[0].Name) {
+		if fs.StrictTypeDetection {
+			// it may be a directory with a file of its name
+			switch err := fs.probeDir(name); {
+			case err == nil:
+				return nil, &listing{name, ls, len(raw)}, nil
+			case err != ErrNotFound:
+				return nil, nil, err
+			}
+		}
 		// it is a file
-		return &ftpFile{
-			sc:    sc,
-			path:  name,
-			size:  int64(ls[0].Size),
-			entry: ftpEntry{ls[0]},
-		}, nil
+		if dirOnly {
+			return nil, nil, errNotDir
+		}
+		f, err := fs.newFile(name, ls[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, nil, nil
+	}
+	return nil, &listing{name, ls, len(raw)}, nil
+}
+
+// newDir returns the directory at path name listing entries, capped at
+// fs.MaxDirEntries. listed is the number of entries LIST returned, "."
+// and ".." included, as servers count them against fs.ListLimit.
+func (fs *FS) newDir(name string, entries []*ftp.Entry, listed int) *ftpDir {
+	entries = trimDots(entries)
+	truncated := fs.ListLimit > 0 && listed == fs.ListLimit
+	if truncated {
+		fs.debugf("listing of %s may be cut at %d entries", name, fs.ListLimit)
+	}
+	if fs.MaxDirEntries > 0 && len(entries) > fs.MaxDirEntries {
+		entries = entries[:fs.MaxDirEntries]
+		truncated = true
+	}
+	d := newFtpDir(name, entries)
+	d.truncated = truncated
+	return d
+}
+
+// abs resolves name against the working directory, so files opened keep
+// their path if it changes later. With fs.HomeRoot, absolute names are
+// resolved against the home directory.
+func (fs *FS) abs(name string) (string, error) {
+	if path.IsAbs(name) && fs.HomeRoot {
+		home, err := fs.homeDir()
+		if err != nil {
+			return "", err
+		}
+		// Clean first, so ".." can not leave home
+		return path.Join(home, path.Clean(name)), nil
+	}
+	if path.IsAbs(name) {
+		return name, nil
+	}
+	dir, err := fs.currentDir()
+	if err != nil {
+		return "", err
 	}
-	return newFtpDir(name, ls), nil
+	return path.Join(dir, name), nil
+}
+
+// homeDir returns the working directory at login, asked with PWD on
+// first use, for fs.HomeRoot.
+func (fs *FS) homeDir() (string, error) {
+	if fs.home == "" {
+		dir, err := fs.currentDir()
+		if err != nil {
+			return "", err
+		}
+		fs.home = dir
+	}
+	return fs.home, nil
+}
+
+// unroot returns the absolute name p as given to Open, under the home
+// directory with fs.HomeRoot.
+func (fs *FS) unroot(p string) string {
+	if !fs.HomeRoot || fs.home == "" {
+		return p
+	}
+	if p == fs.home {
+		return "/"
+	}
+	if rest, ok := strings.CutPrefix(p, strings.TrimSuffix(fs.home, "/")+"/"); ok {
+		return "/" + rest
+	}
+	return p
+}
+
+// ChangeDir changes the working directory of the connection, which
+// relative names are resolved against.
+func (fs *FS) ChangeDir(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.HomeRoot {
+		// resolve "/" to home before leaving it
+		abs, err := fs.abs(name)
+		if err != nil {
+			return err
+		}
+		name = abs
+	}
+	return fs.changeDir(name)
+}
+
+// CurrentDir returns the working directory of the connection. With
+// fs.HomeRoot, it is under the home directory, as given to Open.
+func (fs *FS) CurrentDir() (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.HomeRoot {
+		if _, err := fs.homeDir(); err != nil {
+			return "", err
+		}
+	}
+	dir, err := fs.currentDir()
+	if err != nil {
+		return "", err
+	}
+	return fs.unroot(dir), nil
+}
+
+// newFile returns the File at path name described by e.
+func (fs *FS) newFile(name string, e *ftp.Entry) (*File, error) {
+	if fs.MaxFileSize > 0 && int64(e.Size) > fs.MaxFileSize {
+		return nil, ErrTooLarge
+	}
+	if fs.totalRate == nil {
+		fs.totalRate = newBucket(fs.TotalRateLimit)
+	}
+	return &File{
+		fs:    fs,
+		path:  name,
+		size:  int64(e.Size),
+		entry: ftpEntry{Entry: e},
+		rate:  newBucket(fs.RateLimit),
+		total: fs.totalRate,
+	}, nil
 }
 
 func nameMatch(path, name string) bool {
@@ -56,51 +757,348 @@ func nameMatch(path, name string) bool {
 	return base == name
 }
 
+func nameMatchFold(path, name string) bool {
+	return strings.EqualFold(filepath.Base(path), name) || nameMatch(path, name)
+}
+
+// pickCase looks up name in the listing of its parent, for an entry of
+// the same name but maybe another case. An entry of the exact case is
+// preferred, otherwise between a file and a directory, fs.PreferDir
+// decides.
+func (fs *FS) pickCase(name string) (*ftp.Entry, error) {
+	ls, err := fs.list(path.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	base := path.Base(name)
+	var file, dir *ftp.Entry
+	for _, e := range ls {
+		switch {
+		case e.Name == base:
+			return e, nil
+		case !strings.EqualFold(e.Name, base):
+		case isDir(e):
+			dir = e
+		default:
+			file = e
+		}
+	}
+	if dir != nil && (fs.PreferDir || file == nil) {
+		return dir, nil
+	}
+	if file != nil {
+		return file, nil
+	}
+	return nil, ErrNotFound
+}
+
+// CaseSensitive reports whether the server tells names apart by case, as
+// Unix servers do but Windows servers do not. It is probed once, by
+// looking up an entry of the working directory with its case swapped.
+// It returns ErrUnsupported if no entry has a name with letters.
+func (fs *FS) CaseSensitive() (bool, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.caseSensitive != nil {
+		return *fs.caseSensitive, nil
+	}
+	dir, err := fs.currentDir()
+	if err != nil {
+		return false, err
+	}
+	ls, err := fs.list(dir)
+	if err != nil {
+		return false, err
+	}
+	var probe *ftp.Entry
+	for _, e := range trimDots(ls) {
+		if strings.ToUpper(e.Name) != strings.ToLower(e.Name) {
+			probe = e
+			break
+		}
+	}
+	if probe == nil {
+		return false, ErrUnsupported
+	}
+
+	name := path.Join(dir, swapCase(probe.Name))
+	found := false
+	if isDir(probe) {
+		err = fs.probeDir(name)
+		found = err == nil
+	} else {
+		ls, err = fs.list(name)
+		found = err == nil && len(trimDots(ls)) > 0
+		if c := replyCode(err); c >= 500 && c < 600 {
+			err = nil
+		}
+	}
+	if err != nil && err != ErrNotFound {
+		return false, err
+	}
+	sensitive := !found
+	fs.caseSensitive = &sensitive
+	return sensitive, nil
+}
+
+// swapCase returns s with upper case letters in lower case and the other
+// way around.
+func swapCase(s string) string {
+	return strings.Map(func(r rune) rune {
+		if u := unicode.ToUpper(r); u != r {
+			return u
+		}
+		return unicode.ToLower(r)
+	}, s)
+}
+
 func isDir(e *ftp.Entry) bool {
 	return e.Type == ftp.EntryTypeFolder
 }
 
+// isDot reports whether e is the "." or ".." entry some servers include
+// in LIST output.
+func isDot(e *ftp.Entry) bool {
+	return e.Name == "." || e.Name == ".."
+}
+
+// trimDots returns ls without "." and ".." entries. ls is left as is.
+func trimDots(ls []*ftp.Entry) []*ftp.Entry {
+	b := make([]*ftp.Entry, 0, len(ls))
+	for _, v := range ls {
+		if !isDot(v) {
+			b = append(b, v)
+		}
+	}
+	return b
+}
+
+// replyCode returns the FTP reply code carried by err, or 0.
+func replyCode(err error) int {
+	var te *textproto.Error
+	if errors.As(err, &te) {
+		return te.Code
+	}
+	return 0
+}
+
+// dataConnError reports whether err is a 425 (can't open data connection)
+// or 426 (transfer aborted) reply. The control connection is usually still
+// healthy after them, so the transfer can be retried.
+func dataConnError(err error) bool {
+	code := replyCode(err)
+	return code == 425 || code == 426
+}
+
 var (
-	ErrNotFound = errors.New("File not found")    // Open will return this error when file not found
-	ErrInvalid  = errors.New("invalid argument")  // Seek on ftpFile will return this error when offset < 0
-	ErrReadDir  = errors.New("Read on directory") // Read / Seek on ftpDir will always return this error
-	ErrReadFile = errors.New("Read on file")      // Readdir on ftpFile will always return this error
+	ErrNotFound = isError("File not found", os.ErrNotExist)   // Open will return this error when file not found
+	ErrInvalid  = isError("invalid argument", os.ErrInvalid)  // Seek on File will return this error when offset < 0
+	ErrReadDir  = isError("Read on directory", os.ErrInvalid) // Read / ReadAt / Seek / WriteTo on a directory will always return this error
+	ErrReadFile = isError("Read on file", os.ErrInvalid)      // Readdir on File will always return this error
+
+	ErrUnsupported = errors.New("operation not supported") // the server or FTP client does not support the command
+	ErrTooLarge    = errors.New("file too large")          // Open and Read will return this error when the file exceeds FS.MaxFileSize
+	ErrConnect     = errors.New("cannot connect")          // Dial errors wrap this error when the server cannot be reached
+	ErrAuth        = errors.New("login failed")            // Dial errors wrap this error when the server rejects the login
+
+	ErrTooManyLinks  = errors.New("too many levels of symbolic links") // EvalSymlinks will return this error for a chain of links longer than FS.MaxSymlinkDepth, or looping
+	ErrShortTransfer = isError("short transfer", io.ErrUnexpectedEOF)  // Read and Close return this error, with FS.VerifySize, when a transfer ends before the size of the file
 )
 
+// stdError is an error which also matches a standard error in errors.Is.
+type stdError struct {
+	msg string
+	std error
+}
+
+func isError(msg string, std error) error { return &stdError{msg, std} }
+
+func (e *stdError) Error() string        { return e.msg }
+func (e *stdError) Is(target error) bool { return target == e.std }
+
 const bufLen = 1024
 
-// ftpFile implements http.File
-type ftpFile struct {
-	sc    *ftp.ServerConn
+// File is a file on the FTP server, returned by Open and OpenFile.
+// It implements http.File, io.ReaderAt and io.WriterTo.
+//
+// Operations which use the connection (Read, ReadAt, WriteTo, Close, and
+// the first Seek from the end or Size) are serialized by the FS. Stat and
+// other Seeks do not use the connection. A File must not be used by
+// several goroutines at once.
+type File struct {
+	fs    *FS
 	path  string
 	size  int64
+	sized bool // size is confirmed by SIZE
+	asked bool // SIZE was issued, maybe failing
+	short bool // the transfer ended with ErrShortTransfer
 	entry ftpEntry
+	rate  *bucket // RateLimit
+	total *bucket // TotalRateLimit, shared with the other files of fs
+
+	reported time.Time // last call of FS.Progress
 
 	offset     uint64
 	next       uint64
 	readCloser io.ReadCloser
+	eof        bool // the transfer ended at offset, readCloser is read to the end
 
+	start    uint64 // offset of the current RETR
 	bufStart uint64
-	buf      [bufLen]byte
+	buf      [bufLen]byte // the bytes in [bufStart, offset), bufLen at most
+}
+
+// Close closes the data connection of f, if any. It sends no command
+// otherwise, so it returns nil for a file never read, read to the end, or
+// closed already; Close may be called any number of times. With
+// FS.VerifySize, the first Close after a short transfer returns
+// ErrShortTransfer.
+func (f *File) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.fs.active == f {
+		f.fs.active = nil
+	}
+	err := f.suspend()
+	if f.short {
+		f.short = false
+		if err == nil {
+			err = ErrShortTransfer
+		}
+	}
+	return err
+}
+
+// Reset drops the data connection and the buffered data of f, so the
+// next Read retrieves fresh data from the server at the current position.
+// The size is asked again too. It is useful when the file is known to
+// have changed.
+func (f *File) Reset() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.fs.active == f {
+		f.fs.active = nil
+	}
+	err := f.suspend()
+	// empty the buffer
+	f.offset = f.next
+	f.bufStart = f.next
+	f.sized = false
+	f.asked = false
+	f.eof = false
+	return err
 }
 
-func (f *ftpFile) Close() error {
+// suspend closes the data connection of f, the next Read opens a new one
+// at f.next.
+//
+// A transfer not finished yet is aborted with ABOR if the data stream of
+// the FTP client supports it. Otherwise the data connection is closed,
+// and closing the stream still reads the reply of the transfer, so the
+// control connection is kept in sync.
+func (f *File) suspend() error {
 	if f.readCloser == nil {
 		return nil
 	}
-	err := f.readCloser.Close()
-	if err == nil {
-		f.readCloser = nil
+	rc := f.readCloser
+	f.readCloser = nil
+	if a, ok := rc.(aborter); ok && !f.eof {
+		return a.Abort()
 	}
-	return err
+	return rc.Close()
+}
+
+// aborter is implemented by data streams of FTP clients which can abort
+// the transfer with ABOR, reading all the replies it causes.
+type aborter interface {
+	Abort() error
+}
+
+// Abort stops the transfer in progress, if any. A later Read starts a new
+// one. ABOR is only sent if the data stream of the Conn can Abort, see
+// Conn; otherwise, as with *ftp.ServerConn, the data connection is closed
+// and the reply ending the transfer is read, as Close does.
+func (f *File) Abort() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.fs.active == f {
+		f.fs.active = nil
+	}
+	return f.suspend()
+}
+
+func (f *File) Read(b []byte) (n int, err error) {
+	f.fs.mu.Lock()
+	n, err = f.read(f.limit(b))
+	f.fs.mu.Unlock()
+
+	f.throttle(n)
+	f.progress(err)
+	return n, err
+}
+
+// ReadAt reads len(b) bytes from off. It does not change the offset of
+// Read and Seek.
+func (f *File) ReadAt(b []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, ErrInvalid
+	}
+	f.fs.mu.Lock()
+	next := f.next
+	f.next = uint64(off)
+	for n < len(b) && err == nil {
+		var nn int
+		nn, err = f.read(b[n:])
+		n += nn
+	}
+	f.next = next
+	f.fs.mu.Unlock()
+
+	f.throttle(n)
+	if n == len(b) {
+		err = nil
+	}
+	return n, err
+}
+
+// WriteTo writes the rest of the file to w.
+func (f *File) WriteTo(w io.Writer) (int64, error) {
+	// hide WriteTo from io.Copy
+	return io.CopyBuffer(w, struct{ io.Reader }{f}, make([]byte, 32*1024))
+}
+
+// Size returns the size of the file, confirmed with SIZE when the server
+// supports it.
+func (f *File) Size() int64 {
+	return f.realSize()
 }
 
-func (f *ftpFile) Read(b []byte) (n int, err error) {
+// cache keeps p, just read at f.offset, in buf, so buf holds the last
+// bufLen bytes read at most. A large p is not copied but for its end.
+func (f *File) cache(p []byte) {
+	if len(p) >= bufLen {
+		copy(f.buf[:], p[len(p)-bufLen:])
+		f.bufStart = f.offset + uint64(len(p)) - bufLen
+		return
+	}
+	l := int(f.offset - f.bufStart)
+	keep := l
+	if keep > bufLen-len(p) {
+		keep = bufLen - len(p)
+	}
+	copy(f.buf[:], f.buf[l-keep:l])
+	copy(f.buf[keep:], p)
+	f.bufStart = f.offset - uint64(keep)
+}
+
+// read implements Read with f.fs.mu held.
+func (f *File) read(b []byte) (n int, err error) {
 	if f.next != f.offset {
 		l := f.offset - f.bufStart
-		if l > bufLen {
-			l = bufLen
-		}
 		if f.next >= f.bufStart && f.next < f.bufStart+l {
 			n = copy(b, f.buf[f.next-f.bufStart:l])
 			f.next += uint64(n)
@@ -108,57 +1106,244 @@ func (f *ftpFile) Read(b []byte) (n int, err error) {
 				return n, nil
 			}
 		}
-		if f.readCloser != nil {
-			// TODO: handle close connection correctly !?
-			f.readCloser.Close()
-			f.readCloser = nil
+		if f.next != f.offset {
+			// the data connection is not at f.next
+			f.suspend()
 		}
 	}
-	if f.readCloser == nil {
-		f.readCloser, err = f.sc.RetrFrom(f.path, f.next)
+	// a failed data connection is reopened from the current offset
+	retries := f.fs.ReadRetries
+	if retries <= 0 {
+		retries = 1
+	}
+	for try := 0; ; try++ {
+		retry := try < retries
+		if f.readCloser == nil {
+			if f.eof && f.next == f.offset {
+				// the last transfer ended here
+				return n, io.EOF
+			}
+			if f.sized && f.next >= uint64(f.size) {
+				// nothing to retrieve past the end
+				return n, io.EOF
+			}
+			f.readCloser, err = f.fs.retrFrom(f.path, f.next)
+			if err != nil {
+				f.readCloser = nil
+				if retry && dataConnError(err) {
+					continue
+				}
+				if f.pastEnd(err) {
+					return n, io.EOF
+				}
+				return n, err
+			}
+			f.fs.active = f
+			f.eof = false
+			f.offset = f.next
+			f.start = f.next
+			f.bufStart = f.next
+		}
+		nn, err := f.readStream(b[n:])
+		if max := uint64(f.fs.MaxFileSize); max > 0 && f.offset+uint64(nn) > max {
+			// the listing understated the size, or there was none, as
+			// for OpenAt
+			nn = 0
+			if f.offset < max {
+				nn = int(max - f.offset)
+			}
+			err = ErrTooLarge
+		}
+		if err == io.EOF {
+			f.eof = true
+		}
+		f.fs.bytesRead.Add(int64(nn))
+		f.fs.touch()
+		f.cache(b[n : n+nn])
+		f.offset += uint64(nn)
+		f.next = f.offset
+		n += nn
+		if err == ErrTooLarge {
+			if f.fs.active == f {
+				f.fs.active = nil
+			}
+			f.suspend()
+			return n, err
+		}
+		abort := false
 		if err != nil {
+			var rerr error
+			abort, rerr = f.aborted(err)
+			if rerr != err {
+				// the server failed the transfer it cut short: report
+				// that rather than the end of the file
+				f.eof = false
+				return n, rerr
+			}
+		}
+		if abort {
+			f.eof = false
+			if retry && n == 0 {
+				continue
+			}
+			if n > 0 {
+				// deliver what we have, the next Read reconnects
+				err = nil
+			}
+		}
+		if err == io.EOF && f.readCloser != nil {
+			// read the reply ending the transfer now, so it is not left
+			// on the control connection, and report a failure in it
+			if f.fs.active == f {
+				f.fs.active = nil
+			}
+			rc := f.readCloser
 			f.readCloser = nil
-			return 0, err
+			if cerr := rc.Close(); cerr != nil {
+				// the next Read retrieves the end again
+				f.eof = false
+				err = cerr
+			}
+		}
+		if err == io.EOF && f.fs.VerifySize && f.offset < uint64(f.size) {
+			// only a size confirmed by SIZE is trusted, as in ASCII
+			// mode or with a wrong LIST size the count may differ
+			f.askSize()
+			if f.sized && f.offset < uint64(f.size) {
+				f.short = true
+				err = ErrShortTransfer
+			}
 		}
-		f.offset = f.next
-		f.bufStart = f.next
+		return n, err
+	}
+}
+
+// pastEnd reports whether the RETR failed with err because it started
+// at or after the end of the file, which some servers refuse. The size
+// is asked with SIZE if it is not known yet.
+func (f *File) pastEnd(err error) bool {
+	if f.next == 0 || f.sized || f.asked || replyCode(err) < 500 {
+		return false
+	}
+	f.askSize()
+	return f.sized && f.next >= uint64(f.size)
+}
+
+// readStream reads the data connection, within fs.ReadTimeout if set.
+func (f *File) readStream(b []byte) (int, error) {
+	d := f.fs.ReadTimeout
+	if d <= 0 {
+		return f.readCloser.Read(b)
+	}
+	if dl, ok := f.readCloser.(interface {
+		SetReadDeadline(time.Time) error
+	}); ok && dl.SetReadDeadline(time.Now().Add(d)) == nil {
+		return f.readCloser.Read(b)
 	}
-	nn, err := f.readCloser.Read(b[n:])
-	nn += n
-	if f.offset-f.bufStart < bufLen {
-		copy(f.buf[f.offset-f.bufStart:], b[n:nn])
+
+	// interrupt the Read by closing the stream
+	rc := f.readCloser
+	done := make(chan struct{})
+	t := time.AfterFunc(d, func() {
+		rc.Close()
+		close(done)
+	})
+	n, err := rc.Read(b)
+	if !t.Stop() {
+		<-done
+		f.readCloser = nil
+		return n, os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+// aborted reports whether the transfer ended by err was cut short by a
+// data connection failure, rather than a fatal reply or the end of file.
+// The data connection is closed if so, so the next RETR resumes at
+// f.offset. Otherwise it returns the error to report: the failing reply
+// to a transfer cut short before the size of the file, or err itself.
+func (f *File) aborted(err error) (bool, error) {
+	if f.readCloser == nil {
+		// closed by the ReadTimeout watchdog
+		return false, err
+	}
+	if err == io.EOF && f.offset >= uint64(f.size) {
+		return false, err
+	}
+	cerr := f.readCloser.Close()
+	f.readCloser = nil
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		// a stalled transfer is reported, not retried
+		return false, err
+	}
+	if err == io.EOF {
+		// a short transfer is only an abort if the server says so, or
+		// if nothing came since the RETR when asked to retry that
+		empty := f.offset == f.start
+		if dataConnError(cerr) || f.fs.RetryEmpty && empty {
+			return true, err
+		}
+		if cerr != nil {
+			return false, cerr
+		}
+		return false, err
 	}
-	f.offset += uint64(nn)
-	f.next = f.offset
-	return nn, err
+	return replyCode(cerr) < 500, err
 }
 
-func (f *ftpFile) Seek(offset int64, whence int) (int64, error) {
+// Seek only records the new position, no data transfer is issued until
+// the next Read. So the Seek(0, SEEK_END), Seek(0, SEEK_SET) sequence of
+// http.ServeContent costs nothing.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
 	pos := offset
 	switch whence {
 	case os.SEEK_SET:
 		//Nothing to do
 	case os.SEEK_CUR:
-		pos += int64(f.offset)
+		pos += int64(f.next)
 	case os.SEEK_END:
-		pos += f.size
+		pos += f.realSize()
+	default:
+		return int64(f.next), ErrInvalid
 	}
 	if pos < 0 {
-		return int64(f.offset), ErrInvalid
-	}
-	if uint64(pos) == f.offset {
-		// no change of position
-		return int64(f.offset), nil
+		return int64(f.next), ErrInvalid
 	}
+	// f.next is the logical position, f.offset is the position of the
+	// data connection; Read reconciles them.
 	f.next = uint64(pos)
 	return pos, nil
 }
 
-func (f *ftpFile) Readdir(count int) ([]os.FileInfo, error) {
+// realSize returns the size of f. As the size in LIST output may be wrong
+// or zero, the server is asked with SIZE on first use. The LIST size is
+// kept if SIZE fails.
+func (f *File) realSize() int64 {
+	if !f.sized && !f.asked {
+		f.fs.mu.Lock()
+		defer f.fs.mu.Unlock()
+		f.askSize()
+	}
+	return f.size
+}
+
+// askSize confirms the size of f with SIZE, once, with f.fs.mu held.
+func (f *File) askSize() {
+	if f.sized || f.asked {
+		return
+	}
+	f.asked = true
+	if n, err := f.fs.fileSize(f.path); err == nil {
+		f.size = n
+		f.sized = true
+	}
+}
+
+func (f *File) Readdir(count int) ([]os.FileInfo, error) {
 	return nil, ErrReadFile
 }
 
-func (f *ftpFile) Stat() (os.FileInfo, error) {
+func (f *File) Stat() (os.FileInfo, error) {
 	return f.entry, nil
 }
 
@@ -166,9 +1351,16 @@ func (f *ftpFile) Stat() (os.FileInfo, error) {
 type ftpDir struct {
 	path string
 	fi   []os.FileInfo
+	off  int // position of ReadDir
+
+	truncated bool
 }
 
-type ftpEntry struct{ *ftp.Entry }
+type ftpEntry struct {
+	*ftp.Entry
+	unique string // MLST unique fact, if any
+	typed  bool   // MLST type is a file or a directory, not a link or other
+}
 
 func (e ftpEntry) Name() string       { return e.Entry.Name }
 func (e ftpEntry) Size() int64        { return int64(e.Entry.Size) }
@@ -176,6 +1368,14 @@ func (e ftpEntry) ModTime() time.Time { return e.Entry.Time }
 func (e ftpEntry) IsDir() bool        { return isDir(e.Entry) }
 func (e ftpEntry) Sys() interface{}   { return nil }
 
+// Unique returns the unique fact of MLST, which identifies a file on the
+// server across renames, or "" if the server gives none or MLST is not
+// supported, as with *ftp.ServerConn. It is reached through os.FileInfo
+// with
+//
+//	u, ok := fi.(interface{ Unique() string })
+func (e ftpEntry) Unique() string { return e.unique }
+
 func (e ftpEntry) Mode() os.FileMode {
 	var mode os.FileMode = 0644
 	if e.IsDir() {
@@ -185,10 +1385,15 @@ func (e ftpEntry) Mode() os.FileMode {
 }
 
 func newFtpDir(path string, entries []*ftp.Entry) *ftpDir {
-	b := make([]os.FileInfo, len(entries))
-	for i, v := range entries {
-		b[i] = ftpEntry{v}
+	b := make([]os.FileInfo, 0, len(entries))
+	for _, v := range entries {
+		if isDot(v) {
+			continue
+		}
+		b = append(b, ftpEntry{Entry: v})
 	}
+	// stable, so entries of the same name keep the order of the listing
+	sort.SliceStable(b, func(i, j int) bool { return b[i].Name() < b[j].Name() })
 	return &ftpDir{path: path, fi: b}
 }
 
@@ -204,6 +1409,14 @@ func (d *ftpDir) Seek(offset int64, whence int) (int64, error) {
 	return 0, ErrReadDir
 }
 
+func (d *ftpDir) ReadAt(b []byte, off int64) (n int, err error) {
+	return 0, ErrReadDir
+}
+
+func (d *ftpDir) WriteTo(w io.Writer) (int64, error) {
+	return 0, ErrReadDir
+}
+
 func (d *ftpDir) Readdir(count int) ([]os.FileInfo, error) {
 	if count <= 0 || count > len(d.fi) {
 		return d.fi, nil
@@ -211,11 +1424,17 @@ func (d *ftpDir) Readdir(count int) ([]os.FileInfo, error) {
 	return d.fi[:count], nil
 }
 
+// Truncated reports whether entries were dropped, see FS.MaxDirEntries,
+// or may have been by the server, see FS.ListLimit.
+func (d *ftpDir) Truncated() bool {
+	return d.truncated
+}
+
 func (d *ftpDir) Stat() (os.FileInfo, error) {
 	return d, nil
 }
 
-func (d *ftpDir) Name() string       { return d.path }
+func (d *ftpDir) Name() string       { return path.Base(d.path) }
 func (d *ftpDir) Size() int64        { return 0 }
 func (d *ftpDir) Mode() os.FileMode  { return os.ModeDir | 0644 }
 func (d *ftpDir) ModTime() time.Time { return time.Time{} }
@@ -0,0 +1,1470 @@
+package ftpfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goftp/ftp"
+)
+
+func TestString(t *testing.T) {
+	dial := func(string, *Config) (Conn, error) { return newFakeConn(nil), nil }
+	fs, err := DialWithConfig("ftp.example.com:21", Config{User: "user", Dial: dial})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fs.String(), "ftpfs(user@ftp.example.com)"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	fs.Name = "backup"
+	if got, want := fs.String(), "backup"; got != want {
+		t.Errorf("String() with Name = %q, want %q", got, want)
+	}
+	if got, want := NewConn(newFakeConn(nil)).String(), "ftpfs"; got != want {
+		t.Errorf("String() of NewConn = %q, want %q", got, want)
+	}
+}
+
+func TestDotEntries(t *testing.T) {
+	c := newFakeConn(map[string]string{"/d/a.txt": "a"})
+	dots := []*ftp.Entry{
+		{Name: ".", Type: ftp.EntryTypeFolder},
+		{Name: "..", Type: ftp.EntryTypeFolder},
+	}
+	c.dirs["/d"] = append(dots, c.dirs["/d"]...)
+	fs := NewConn(c)
+
+	f, err := fs.Open("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := f.Readdir(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fi) != 1 || fi[0].Name() != "a.txt" {
+		t.Fatalf("Readdir = %v, want a.txt only", fi)
+	}
+
+	de, err := iofs.ReadDir(fs.IOFS(), "d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(de) != 1 || de[0].Name() != "a.txt" {
+		t.Fatalf("ReadDir = %v, want a.txt only", de)
+	}
+}
+
+// flakyConn is a fakeConn whose first RETR is cut after cut bytes: the
+// data stream then fails to Read with readErr, io.EOF if nil, and its
+// Close returns closeErr, the reply ending the transfer.
+type flakyConn struct {
+	*fakeConn
+	cut      int
+	readErr  error
+	closeErr error
+}
+
+func (c *flakyConn) RetrFrom(name string, offset uint64) (io.ReadCloser, error) {
+	rc, err := c.fakeConn.RetrFrom(name, offset)
+	if err != nil || c.cut < 0 {
+		return rc, err
+	}
+	s := &cutStream{io.LimitReader(rc, int64(c.cut)), c.readErr, c.closeErr}
+	c.cut = -1
+	return s, nil
+}
+
+type cutStream struct {
+	r        io.Reader
+	readErr  error
+	closeErr error
+}
+
+func (s *cutStream) Read(b []byte) (int, error) {
+	n, err := s.r.Read(b)
+	if err == io.EOF && s.readErr != nil {
+		err = s.readErr
+	}
+	return n, err
+}
+
+func (s *cutStream) Close() error { return s.closeErr }
+
+func TestReadRetryDataConnError(t *testing.T) {
+	c := &flakyConn{
+		fakeConn: newFakeConn(map[string]string{"/a.txt": "0123456789"}),
+		cut:      4,
+		closeErr: &textproto.Error{Code: 426, Msg: "Transfer aborted"},
+	}
+	f, err := NewConn(c).Open("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "0123456789" {
+		t.Fatalf("read %q, want %q", b, "0123456789")
+	}
+	if n := c.count("RETR"); n != 2 || c.count("REST 4") != 1 {
+		t.Fatalf("sent %q, want a second RETR from 4", c.sent)
+	}
+}
+
+func TestReadShortTransferReply(t *testing.T) {
+	c := &flakyConn{
+		fakeConn: newFakeConn(map[string]string{"/a.txt": "0123456789"}),
+		cut:      4,
+		closeErr: &textproto.Error{Code: 451, Msg: "Local error in processing"},
+	}
+	f, err := NewConn(c).Open("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(f)
+	if string(b) != "0123" || replyCode(err) != 451 {
+		t.Fatalf("ReadAll = %q, %v; want %q and the 451 reply", b, err, "0123")
+	}
+}
+
+func TestErrorsIs(t *testing.T) {
+	fs := NewConn(newFakeConn(map[string]string{"/d/a.txt": "a"}))
+	d, err := fs.Open("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.Read(make([]byte, 1))
+	if err != ErrReadDir || !errors.Is(err, iofs.ErrInvalid) {
+		t.Errorf("Read on a directory: %v, want ErrReadDir matching fs.ErrInvalid", err)
+	}
+	_, err = d.Seek(0, io.SeekStart)
+	if err != ErrReadDir || !errors.Is(err, iofs.ErrInvalid) {
+		t.Errorf("Seek on a directory: %v, want ErrReadDir matching fs.ErrInvalid", err)
+	}
+
+	f, err := fs.Open("/d/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Readdir(0)
+	if err != ErrReadFile || !errors.Is(err, iofs.ErrInvalid) {
+		t.Errorf("Readdir on a file: %v, want ErrReadFile matching fs.ErrInvalid", err)
+	}
+	_, err = f.Seek(-1, io.SeekStart)
+	if err != ErrInvalid || !errors.Is(err, iofs.ErrInvalid) {
+		t.Errorf("Seek before the start: %v, want ErrInvalid matching fs.ErrInvalid", err)
+	}
+
+	_, err = fs.Open("/d/missing")
+	if err != ErrNotFound || !errors.Is(err, iofs.ErrNotExist) {
+		t.Errorf("Open of a missing file: %v, want ErrNotFound matching fs.ErrNotExist", err)
+	}
+}
+
+func TestMaxFileSize(t *testing.T) {
+	c := newFakeConn(map[string]string{"/d/small": "12345", "/d/large": "123456"})
+	fs := NewConn(c)
+	fs.MaxFileSize = 5
+	if _, err := fs.Open("/d/small"); err != nil {
+		t.Errorf("Open of a file at the limit: %v", err)
+	}
+	if _, err := fs.Open("/d/large"); err != ErrTooLarge {
+		t.Errorf("Open of a file over the limit: %v, want ErrTooLarge", err)
+	}
+	if _, err := fs.Open("/d"); err != nil {
+		t.Errorf("Open of a directory: %v", err)
+	}
+	if n := c.count("RETR"); n != 0 {
+		t.Errorf("%d RETR sent, want none", n)
+	}
+
+	// a file listed smaller than it is fails while read
+	sc := sizeConn{newFakeConn(map[string]string{"/a.txt": "0123456789"})}
+	sc.entry("/a.txt").Size = 0
+	fs = NewConn(sc)
+	fs.MaxFileSize = 5
+	f, err := fs.Open("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(f)
+	if string(b) != "01234" || err != ErrTooLarge {
+		t.Errorf("ReadAll = %q, %v; want %q and ErrTooLarge", b, err, "01234")
+	}
+	f.Close()
+	rc, err := fs.OpenAt("/a.txt", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = io.ReadAll(rc)
+	if string(b) != "234" || err != ErrTooLarge {
+		t.Errorf("ReadAll from OpenAt = %q, %v; want %q and ErrTooLarge", b, err, "234")
+	}
+	rc.Close()
+}
+
+func TestSizeFromSIZE(t *testing.T) {
+	c := sizeConn{newFakeConn(map[string]string{"/a.txt": "0123456789"})}
+	c.entry("/a.txt").Size = 3 // LIST is wrong
+	f, err := NewConn(c).OpenFile("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := f.Seek(0, io.SeekEnd); n != 10 || err != nil {
+		t.Fatalf("Seek to the end = %d, %v; want 10", n, err)
+	}
+	if n := f.Size(); n != 10 {
+		t.Fatalf("Size() = %d, want 10", n)
+	}
+	if n := c.count("SIZE"); n != 1 {
+		t.Fatalf("%d SIZE sent, want 1 as the size is cached", n)
+	}
+}
+
+func TestInterleavedReads(t *testing.T) {
+	c := newFakeConn(map[string]string{"/a": "aaaaaaaaaabbbbbbbbbb", "/b": "0123456789abcdefghij"})
+	fs := NewConn(c)
+	a, err := fs.Open("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := fs.Open("/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [2][]byte
+	buf := make([]byte, 3)
+	for done := 0; done != 3; {
+		for i, f := range []http.File{a, b} {
+			n, err := f.Read(buf)
+			got[i] = append(got[i], buf[:n]...)
+			if err == io.EOF {
+				done |= 1 << i
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if string(got[0]) != c.files["/a"] || string(got[1]) != c.files["/b"] {
+		t.Fatalf("read %q and %q", got[0], got[1])
+	}
+}
+
+func TestRetryEmpty(t *testing.T) {
+	c := &flakyConn{fakeConn: newFakeConn(map[string]string{"/a.txt": "0123456789", "/empty": ""})}
+	fs := NewConn(c)
+	fs.RetryEmpty = true
+	f, err := fs.Open("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "0123456789" || c.count("RETR") != 2 {
+		t.Fatalf("read %q with %d RETR, want %q with 2", b, c.count("RETR"), "0123456789")
+	}
+
+	f, err = fs.Open("/empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = io.ReadAll(f)
+	if err != nil || len(b) != 0 {
+		t.Fatalf("read %q, %v from an empty file", b, err)
+	}
+	if n := c.count("RETR /empty"); n != 1 {
+		t.Fatalf("%d RETR of an empty file, want 1", n)
+	}
+}
+
+func TestTrailingSlash(t *testing.T) {
+	c := newFakeConn(map[string]string{"/d/a.txt": "a", "/d/b.txt": "b"})
+	fs := NewConn(c)
+	var listings []string
+	for _, name := range []string{"/d", "/d/"} {
+		f, err := fs.Open(name)
+		if err != nil {
+			t.Fatalf("Open(%q): %v", name, err)
+		}
+		fi, err := f.Readdir(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listings = append(listings, names(fi))
+	}
+	if listings[0] != "a.txt b.txt" || listings[1] != listings[0] {
+		t.Fatalf("listings of /d and /d/: %q", listings)
+	}
+	if c.sent[0] != "LIST /d" || c.sent[1] != "LIST /d" {
+		t.Fatalf("sent %q, want LIST /d twice", c.sent)
+	}
+	if _, err := fs.Open("/d/a.txt/"); err != ErrNotFound {
+		t.Fatalf("Open of a file with a slash: %v, want ErrNotFound", err)
+	}
+}
+
+// dirsOnlyConn is a sizeConn of a server which only lists directories.
+type dirsOnlyConn struct {
+	sizeConn
+}
+
+func (c dirsOnlyConn) List(name string) ([]*ftp.Entry, error) {
+	if _, ok := c.files[c.abs(name)]; ok {
+		c.sent = append(c.sent, "LIST "+name)
+		return nil, &textproto.Error{Code: 550, Msg: "Not a directory"}
+	}
+	return c.sizeConn.List(name)
+}
+
+func TestSizeFallback(t *testing.T) {
+	c := dirsOnlyConn{sizeConn{newFakeConn(map[string]string{"/d/a.txt": "hello"})}}
+	fs := NewConn(c)
+	if _, err := fs.Open("/d/a.txt"); replyCode(err) != 550 {
+		t.Fatalf("Open without SizeFallback: %v, want the 550 reply", err)
+	}
+
+	fs.SizeFallback = true
+	f, err := fs.Open("/d/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, _ := f.Stat()
+	if string(b) != "hello" || fi.Size() != 5 || fi.IsDir() {
+		t.Fatalf("read %q, size %d, dir %t", b, fi.Size(), fi.IsDir())
+	}
+	if _, err := fs.Open("/d/missing"); err != ErrNotFound {
+		t.Fatalf("Open of a missing file: %v, want ErrNotFound", err)
+	}
+}
+
+func TestReadResume(t *testing.T) {
+	c := &flakyConn{
+		fakeConn: newFakeConn(map[string]string{"/a.txt": "0123456789"}),
+		cut:      4,
+		readErr:  errors.New("connection reset by peer"),
+	}
+	fs := NewConn(c)
+	fs.ReadRetries = 2
+	f, err := fs.Open("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "0123456789" {
+		t.Fatalf("read %q, want %q", b, "0123456789")
+	}
+	if c.count("REST 4") != 1 {
+		t.Fatalf("sent %q, want a resume from 4", c.sent)
+	}
+	// the positions before and after the resume still match the file
+	b = make([]byte, 4)
+	if _, err := f.(io.ReaderAt).ReadAt(b, 2); err != nil || string(b) != "2345" {
+		t.Fatalf("ReadAt 2 = %q, %v; want %q", b, err, "2345")
+	}
+}
+
+func TestBytesRead(t *testing.T) {
+	fs := NewConn(newFakeConn(map[string]string{"/a.txt": "0123456789"}))
+	f, err := fs.Open("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(f); err != nil {
+		t.Fatal(err)
+	}
+	// read again from the buffer
+	f.Seek(2, io.SeekStart)
+	if _, err := io.ReadAll(f); err != nil {
+		t.Fatal(err)
+	}
+	if n := fs.BytesRead(); n != 10 {
+		t.Fatalf("BytesRead() = %d, want 10", n)
+	}
+	fs.ResetBytesRead()
+	if n := fs.BytesRead(); n != 0 {
+		t.Fatalf("BytesRead() after ResetBytesRead = %d, want 0", n)
+	}
+}
+
+func TestOpenRelative(t *testing.T) {
+	c := newFakeConn(map[string]string{"/d/a.txt": "a", "/a.txt": "root"})
+	fs := NewConn(c)
+	if err := fs.ChangeDir("/d"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Open("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil || string(b) != "a" {
+		t.Fatalf("read %q, %v; want %q", b, err, "a")
+	}
+	if c.count("LIST /d/a.txt") != 1 {
+		t.Fatalf("sent %q, want LIST /d/a.txt", c.sent)
+	}
+}
+
+func TestMaxDirEntries(t *testing.T) {
+	files := make(map[string]string)
+	for i := 0; i < 5; i++ {
+		files[fmt.Sprintf("/d/%d", i)] = ""
+	}
+	fs := NewConn(newFakeConn(files))
+	fs.MaxDirEntries = 3
+	f, err := fs.Open("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := f.Readdir(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fi) != 3 || !f.(interface{ Truncated() bool }).Truncated() {
+		t.Fatalf("Readdir = %v, want 3 entries and Truncated", fi)
+	}
+
+	fs.MaxDirEntries = 5
+	f, err = fs.Open("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.(interface{ Truncated() bool }).Truncated() {
+		t.Fatal("Truncated at the cap, want not")
+	}
+}
+
+func TestReset(t *testing.T) {
+	c := newFakeConn(map[string]string{"/a.txt": "0123456789"})
+	f, err := NewConn(c).OpenFile("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(f, b); err != nil {
+		t.Fatal(err)
+	}
+	c.files["/a.txt"] = "abcdefghij"
+	if err := f.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := io.ReadAll(f)
+	if err != nil || string(rest) != "efghij" {
+		t.Fatalf("read %q, %v after Reset; want %q", rest, err, "efghij")
+	}
+	// the buffer is not replayed either
+	f.Seek(0, io.SeekStart)
+	if _, err := io.ReadFull(f, b); err != nil || string(b) != "abcd" {
+		t.Fatalf("read %q, %v from the start; want %q", b, err, "abcd")
+	}
+}
+
+func TestLastUsed(t *testing.T) {
+	fs := NewConn(newFakeConn(map[string]string{"/a.txt": "a"}))
+	idle := time.Now().Add(-time.Hour)
+	fs.lastUsed.Store(idle.UnixNano())
+	if !fs.LastUsed().Equal(idle) {
+		t.Fatalf("LastUsed() = %v, want %v", fs.LastUsed(), idle)
+	}
+	start := time.Now()
+	if _, err := fs.Open("/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if fs.LastUsed().Before(start) {
+		t.Fatalf("LastUsed() = %v after Open at %v", fs.LastUsed(), start)
+	}
+}
+
+func TestOpenEmptyName(t *testing.T) {
+	c := newFakeConn(map[string]string{"/d/a.txt": "a"})
+	fs := NewConn(c)
+	if err := fs.ChangeDir("/d"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.IsDir() || fi.Name() != "d" {
+		t.Fatalf("Open(\"\") is %v, %v; want the directory d", fi, err)
+	}
+	if c.count("LIST /d") != 1 {
+		t.Fatalf("sent %q, want LIST /d", c.sent)
+	}
+}
+
+// foldConn is a fakeConn of a case insensitive server. A name without an
+// entry of its case is looked up ignoring case, files first.
+type foldConn struct {
+	*fakeConn
+}
+
+func (c foldConn) fold(name string) string {
+	name = c.abs(name)
+	if _, ok := c.dirs[name]; ok || c.entry(name) != nil {
+		return name
+	}
+	var dir string
+	for _, e := range c.dirs[c.fold(path.Dir(name))] {
+		if !strings.EqualFold(e.Name, path.Base(name)) {
+			continue
+		}
+		p := path.Join(c.fold(path.Dir(name)), e.Name)
+		if !isDir(e) {
+			return p
+		}
+		dir = p
+	}
+	if dir != "" {
+		return dir
+	}
+	return name
+}
+
+func (c foldConn) List(name string) ([]*ftp.Entry, error) {
+	ls, err := c.fakeConn.List(c.fold(name))
+	c.sent[len(c.sent)-1] = "LIST " + name
+	return ls, err
+}
+
+func (c foldConn) ChangeDir(name string) error {
+	err := c.fakeConn.ChangeDir(c.fold(name))
+	c.sent[len(c.sent)-1] = "CWD " + name
+	return err
+}
+
+func (c foldConn) RetrFrom(name string, offset uint64) (io.ReadCloser, error) {
+	return c.fakeConn.RetrFrom(c.fold(name), offset)
+}
+
+func TestCaseCollision(t *testing.T) {
+	// the directory Notes holds a single file of its name in lower case
+	_, isDir, err := NewConn(newFakeConn(map[string]string{"/d/Notes/notes": "n"})).OpenType("/d/Notes")
+	if err != nil || !isDir {
+		t.Fatalf("OpenType(/d/Notes) = %t, %v; want the directory", isDir, err)
+	}
+
+	// a file notes and a directory NOTES, neither of the case asked
+	c := foldConn{newFakeConn(map[string]string{"/d/notes": "n", "/d/NOTES/a.txt": "a"})}
+	fs := NewConn(c)
+	if _, isDir, err := fs.OpenType("/d/Notes"); err != nil || isDir {
+		t.Fatalf("OpenType(/d/Notes) = %t, %v; want the file", isDir, err)
+	}
+	fs.PreferDir = true
+	if _, isDir, err := fs.OpenType("/d/Notes"); err != nil || !isDir {
+		t.Fatalf("OpenType(/d/Notes) with PreferDir = %t, %v; want the directory", isDir, err)
+	}
+	// the exact case wins
+	if _, isDir, err := fs.OpenType("/d/notes"); err != nil || isDir {
+		t.Fatalf("OpenType(/d/notes) with PreferDir = %t, %v; want the file", isDir, err)
+	}
+}
+
+// abortConn is a fakeConn whose data streams can abort, see aborter.
+type abortConn struct {
+	*fakeConn
+}
+
+func (c abortConn) RetrFrom(name string, offset uint64) (io.ReadCloser, error) {
+	rc, err := c.fakeConn.RetrFrom(name, offset)
+	if err != nil {
+		return nil, err
+	}
+	return abortStream{rc, c.fakeConn}, nil
+}
+
+type abortStream struct {
+	io.ReadCloser
+	c *fakeConn
+}
+
+func (s abortStream) Abort() error {
+	s.c.sent = append(s.c.sent, "ABOR")
+	return nil
+}
+
+func TestAbort(t *testing.T) {
+	c := abortConn{newFakeConn(map[string]string{"/a.txt": "0123456789", "/b.txt": "b"})}
+	fs := NewConn(c)
+	f, err := fs.OpenFile("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 3)
+	if _, err := io.ReadFull(f, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if c.count("ABOR") != 1 {
+		t.Fatalf("sent %q, want ABOR", c.sent)
+	}
+
+	// the connection is still usable, and so is f
+	g, err := fs.Open("/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(g); err != nil || string(b) != "b" {
+		t.Fatalf("read %q, %v after ABOR; want %q", b, err, "b")
+	}
+	if b, err := io.ReadAll(f); err != nil || string(b) != "3456789" {
+		t.Fatalf("read %q, %v after Abort; want %q", b, err, "3456789")
+	}
+	// a transfer read to the end is not aborted
+	if err := f.Close(); err != nil || c.count("ABOR") != 1 {
+		t.Fatalf("Close at the end: %v, sent %q", err, c.sent)
+	}
+}
+
+func TestReadDirErrors(t *testing.T) {
+	fs := NewConn(newFakeConn(map[string]string{"/d/a.txt": "a"}))
+	d, err := fs.Open("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	for op, read := range map[string]func() error{
+		"Read":    func() error { _, err := d.Read(b); return err },
+		"ReadAt":  func() error { _, err := d.(io.ReaderAt).ReadAt(b, 0); return err },
+		"Seek":    func() error { _, err := d.Seek(0, io.SeekEnd); return err },
+		"WriteTo": func() error { _, err := d.(io.WriterTo).WriteTo(io.Discard); return err },
+	} {
+		if err := read(); err != ErrReadDir || !errors.Is(err, iofs.ErrInvalid) {
+			t.Errorf("%s on a directory: %v, want ErrReadDir", op, err)
+		}
+	}
+}
+
+// stallConn is a fakeConn whose data streams stall after cut bytes, until
+// they are closed.
+type stallConn struct {
+	*fakeConn
+	cut int64
+}
+
+func (c stallConn) RetrFrom(name string, offset uint64) (io.ReadCloser, error) {
+	rc, err := c.fakeConn.RetrFrom(name, offset)
+	if err != nil {
+		return nil, err
+	}
+	return &stallStream{r: io.LimitReader(rc, c.cut), closed: make(chan struct{})}, nil
+}
+
+type stallStream struct {
+	r      io.Reader
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (s *stallStream) Read(b []byte) (int, error) {
+	if n, err := s.r.Read(b); err != io.EOF {
+		return n, err
+	}
+	<-s.closed
+	return 0, net.ErrClosed
+}
+
+func (s *stallStream) Close() error {
+	s.once.Do(func() { close(s.closed) })
+	return nil
+}
+
+func TestReadTimeout(t *testing.T) {
+	c := stallConn{newFakeConn(map[string]string{"/a.txt": "0123456789"}), 4}
+	fs := NewConn(c)
+	fs.ReadTimeout = 50 * time.Millisecond
+	f, err := fs.Open("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	b, err := io.ReadAll(f)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read %q, %v; want os.ErrDeadlineExceeded", b, err)
+	}
+	if string(b) != "0123" {
+		t.Fatalf("read %q before the stall, want %q", b, "0123")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("stalled Read returned after %v", d)
+	}
+}
+
+func TestOpenType(t *testing.T) {
+	fs := NewConn(newFakeConn(map[string]string{"/d/a.txt": "a"}))
+	for name, want := range map[string]bool{"/d": true, "/d/a.txt": false} {
+		f, isDir, err := fs.OpenType(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi, _ := f.Stat(); isDir != want || fi.IsDir() != want {
+			t.Errorf("OpenType(%q) = %t, want %t", name, isDir, want)
+		}
+	}
+	if _, _, err := fs.OpenType("/missing"); err != ErrNotFound {
+		t.Errorf("OpenType of a missing name: %v, want ErrNotFound", err)
+	}
+}
+
+func TestOpenAt(t *testing.T) {
+	c := newFakeConn(map[string]string{"/a.txt": "0123456789"})
+	fs := NewConn(c)
+	r, err := fs.OpenAt("/a.txt", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if string(b) != "456789" {
+		t.Fatalf("read %q, want %q", b, "456789")
+	}
+	want := []string{"REST 4", "RETR /a.txt"}
+	if strings.Join(c.sent, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("sent %q, want %q", c.sent, want)
+	}
+	if _, err := fs.OpenAt("/a.txt", -1); err != ErrInvalid {
+		t.Fatalf("OpenAt a negative offset: %v, want ErrInvalid", err)
+	}
+	if _, err := fs.OpenAt("/missing", 4); err == nil {
+		t.Fatal("OpenAt of a missing file succeeded")
+	}
+}
+
+func TestConcurrentReadDir(t *testing.T) {
+	files := make(map[string]string)
+	for i := 0; i < 8; i++ {
+		files[fmt.Sprintf("/d%d/a.txt", i)] = "a"
+		files[fmt.Sprintf("/d%d/b.txt", i)] = "b"
+	}
+	// fakeConn is not safe for concurrent use: FS must serialize commands
+	fs := NewConn(newFakeConn(files))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(dir string) {
+			defer wg.Done()
+			f, err := fs.Open(dir)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer f.Close()
+			fi, err := f.Readdir(0)
+			if err != nil || len(fi) != 2 || fi[0].Name() != "a.txt" || fi[1].Name() != "b.txt" {
+				t.Errorf("Readdir(%s) = %v, %v", dir, fi, err)
+			}
+		}(fmt.Sprintf("/d%d", i))
+	}
+	wg.Wait()
+}
+
+func TestSeekBackInBuffer(t *testing.T) {
+	data := testData(2000)
+	c := newFakeConn(map[string]string{"/f": data})
+	fs := NewConn(c)
+	f, err := fs.Open("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b := make([]byte, 1500)
+	if _, err := io.ReadFull(f, b); err != nil {
+		t.Fatal(err)
+	}
+	// the buffer holds the last bufLen bytes read, from 1500-bufLen
+	bufStart := int64(1500 - bufLen)
+	readAt := func(pos int64, n int) {
+		t.Helper()
+		if _, err := f.Seek(pos, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(f, b); err != nil {
+			t.Fatal(err)
+		}
+		if want := data[pos : pos+int64(n)]; string(b) != want {
+			t.Fatalf("read %q at %d, want %q", b, pos, want)
+		}
+	}
+	readAt(bufStart, 10)
+	readAt(1499, 1)
+	// through its end, the buffer goes on with the data connection
+	readAt(1499, 11)
+	if n := c.count("RETR"); n != 1 {
+		t.Fatalf("sent %q, want a single RETR for seeks within the buffer", c.sent)
+	}
+	readAt(bufStart-1, 10)
+	if n := c.count("RETR"); n != 2 || c.sent[len(c.sent)-2] != fmt.Sprintf("REST %d", bufStart-1) {
+		t.Fatalf("sent %q, want a RETR from %d for a seek before the buffer", c.sent, bufStart-1)
+	}
+}
+
+func TestNotFoundTTL(t *testing.T) {
+	c := newFakeConn(map[string]string{"/d/a.txt": "a"})
+	fs := NewConn(c)
+	fs.NotFoundTTL = time.Minute
+	if _, err := fs.Open("/d/missing"); err != ErrNotFound {
+		t.Fatalf("Open of a missing file: %v, want ErrNotFound", err)
+	}
+	n := len(c.sent)
+	if _, err := fs.Open("/d/missing"); err != ErrNotFound {
+		t.Fatalf("second Open of a missing file: %v, want ErrNotFound", err)
+	}
+	if len(c.sent) != n {
+		t.Fatalf("second Open sent %q, want nothing", c.sent[n:])
+	}
+
+	// once expired, the server is asked again
+	c.files["/d/missing"] = "new"
+	c.dirs["/d"] = append(c.dirs["/d"], &ftp.Entry{Name: "missing", Type: ftp.EntryTypeFile, Size: 3, Time: fakeTime})
+	fs.notFound["/d/missing"] = time.Now().Add(-time.Second)
+	if _, err := fs.Open("/d/missing"); err != nil {
+		t.Fatalf("Open after the TTL: %v", err)
+	}
+}
+
+func TestNotFoundTTLNotDir(t *testing.T) {
+	c := newFakeConn(map[string]string{"/a.txt": "a"})
+	fs := NewConn(c)
+	fs.NotFoundTTL = time.Minute
+	if _, err := fs.Open("/a.txt/"); err != ErrNotFound {
+		t.Fatalf("Open of a file as a directory: %v, want ErrNotFound", err)
+	}
+	// the file is still found without the slash
+	f, err := fs.Open("/a.txt")
+	if err != nil {
+		t.Fatalf("Open after opening it as a directory: %v", err)
+	}
+	f.Close()
+	if _, err := fs.Stat("/a.txt"); err != nil {
+		t.Fatalf("Stat after opening it as a directory: %v", err)
+	}
+}
+
+func TestCloseIdempotent(t *testing.T) {
+	c := newFakeConn(map[string]string{"/d/a.txt": "0123456789"})
+	fs := NewConn(c)
+	for _, tt := range []struct {
+		name string
+		use  func(f http.File) error
+	}{
+		{"open", func(http.File) error { return nil }},
+		{"seek", func(f http.File) error {
+			_, err := f.Seek(4, io.SeekStart)
+			return err
+		}},
+		{"read", func(f http.File) error {
+			_, err := f.Read(make([]byte, 4))
+			return err
+		}},
+		{"dir", nil},
+	} {
+		name := "/d/a.txt"
+		if tt.use == nil {
+			name = "/d"
+		}
+		f, err := fs.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.use != nil {
+			if err := tt.use(f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 2; i++ {
+			if err := f.Close(); err != nil {
+				t.Errorf("%s: Close #%d: %v", tt.name, i+1, err)
+			}
+		}
+	}
+	if n := c.count("RETR"); n != 1 {
+		t.Fatalf("sent %q, want a RETR for the read only", c.sent)
+	}
+}
+
+// lossyConn is a fakeConn which lists nothing for the first *empty LIST.
+type lossyConn struct {
+	*fakeConn
+	empty *int
+}
+
+func (c lossyConn) List(name string) ([]*ftp.Entry, error) {
+	ls, err := c.fakeConn.List(name)
+	if *c.empty > 0 {
+		*c.empty--
+		return nil, err
+	}
+	return ls, err
+}
+
+func TestListRetries(t *testing.T) {
+	files := map[string]string{"/d/a.txt": "a", "/empty/": ""}
+	for _, tt := range []struct {
+		retries, empty int
+		name           string
+		want, lists    int
+	}{
+		{0, 1, "/d", 0, 1},
+		{2, 1, "/d", 1, 2},
+		{2, 2, "/d", 1, 3},
+		{2, 0, "/empty", 0, 3},
+	} {
+		empty := tt.empty
+		c := lossyConn{newFakeConn(files), &empty}
+		fs := NewConn(c)
+		fs.ListRetries = tt.retries
+		f, err := fs.Open(tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := f.Readdir(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fi) != tt.want || c.count("LIST") != tt.lists {
+			t.Errorf("ListRetries %d, %d empty replies: %d entries with %d LIST, want %d with %d",
+				tt.retries, tt.empty, len(fi), c.count("LIST"), tt.want, tt.lists)
+		}
+	}
+}
+
+func TestCaseSensitive(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		files map[string]string
+		fold  bool
+		want  bool
+	}{
+		{"file, Unix", map[string]string{"/Readme.txt": "r"}, false, true},
+		{"file, Windows", map[string]string{"/Readme.txt": "r"}, true, false},
+		{"directory, Unix", map[string]string{"/Docs/": ""}, false, true},
+		{"directory, Windows", map[string]string{"/Docs/": ""}, true, false},
+	} {
+		c := newFakeConn(tt.files)
+		var conn Conn = c
+		if tt.fold {
+			conn = foldConn{c}
+		}
+		fs := NewConn(conn)
+		for i := 0; i < 2; i++ {
+			got, err := fs.CaseSensitive()
+			if err != nil || got != tt.want {
+				t.Errorf("%s: CaseSensitive() = %t, %v; want %t", tt.name, got, err, tt.want)
+			}
+		}
+		if n := c.count("PWD"); n != 1 {
+			t.Errorf("%s: sent %q, want a single probe", tt.name, c.sent)
+		}
+	}
+
+	fs := NewConn(newFakeConn(map[string]string{"/2020/": ""}))
+	if _, err := fs.CaseSensitive(); err != ErrUnsupported {
+		t.Fatalf("CaseSensitive() without letters: %v, want ErrUnsupported", err)
+	}
+}
+
+// pastEndConn is a fakeConn which refuses a RETR from the end of the file
+// or after it, and answers SIZE if size is set.
+type pastEndConn struct {
+	*fakeConn
+	size bool
+}
+
+func (c pastEndConn) RetrFrom(name string, offset uint64) (io.ReadCloser, error) {
+	if s, ok := c.files[c.abs(name)]; ok && offset >= uint64(len(s)) {
+		c.sent = append(c.sent, fmt.Sprintf("REST %d", offset), "RETR "+name)
+		return nil, &textproto.Error{Code: 554, Msg: "Restart offset past end"}
+	}
+	return c.fakeConn.RetrFrom(name, offset)
+}
+
+func (c pastEndConn) FileSize(name string) (int64, error) {
+	if !c.size {
+		c.sent = append(c.sent, "SIZE "+name)
+		return 0, &textproto.Error{Code: 502, Msg: "Command not implemented"}
+	}
+	return sizeConn{c.fakeConn}.FileSize(name)
+}
+
+func TestReadPastEnd(t *testing.T) {
+	files := map[string]string{"/a.txt": "0123456789"}
+
+	// the size is known from seeking relative to the end
+	c := pastEndConn{newFakeConn(files), true}
+	f, err := NewConn(c).Open("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Seek(5, io.SeekEnd)
+	if b, err := io.ReadAll(f); err != nil || len(b) != 0 {
+		t.Fatalf("read %q, %v past the end; want nothing", b, err)
+	}
+	if n := c.count("RETR"); n != 0 {
+		t.Fatalf("sent %q, want no RETR past the end of a known size", c.sent)
+	}
+
+	// the size is asked when the server refuses the RETR
+	c = pastEndConn{newFakeConn(files), true}
+	f, err = NewConn(c).Open("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Seek(20, io.SeekStart)
+	if n, err := f.Read(make([]byte, 4)); n != 0 || err != io.EOF {
+		t.Fatalf("Read past the end = %d, %v; want io.EOF", n, err)
+	}
+	if c.count("SIZE") != 1 {
+		t.Fatalf("sent %q, want SIZE after the refused RETR", c.sent)
+	}
+
+	// without SIZE, the error of the server is returned
+	c = pastEndConn{newFakeConn(files), false}
+	f, err = NewConn(c).Open("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Seek(20, io.SeekStart)
+	if _, err := f.Read(make([]byte, 4)); replyCode(err) != 554 {
+		t.Fatalf("Read past the end without SIZE: %v, want the 554 reply", err)
+	}
+}
+
+// shortConn is a flakyConn which answers SIZE.
+type shortConn struct {
+	*flakyConn
+}
+
+func (c shortConn) FileSize(name string) (int64, error) {
+	return sizeConn{c.fakeConn}.FileSize(name)
+}
+
+func TestVerifySize(t *testing.T) {
+	files := map[string]string{"/a.txt": "0123456789"}
+	for _, tt := range []struct {
+		verify bool
+		cut    int
+		want   error
+	}{
+		{true, 4, ErrShortTransfer},
+		{false, 4, nil},
+		{true, -1, nil},
+	} {
+		fs := NewConn(shortConn{&flakyConn{fakeConn: newFakeConn(files), cut: tt.cut}})
+		fs.VerifySize = tt.verify
+		f, err := fs.Open("/a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(f)
+		if err != tt.want || tt.want != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("VerifySize %t, cut at %d: read %q, %v; want %v", tt.verify, tt.cut, b, err, tt.want)
+		}
+		if err := f.Close(); err != tt.want {
+			t.Errorf("VerifySize %t, cut at %d: Close: %v, want %v", tt.verify, tt.cut, err, tt.want)
+		}
+		if err := f.Close(); err != nil {
+			t.Errorf("second Close: %v", err)
+		}
+	}
+}
+
+func TestOpenStat(t *testing.T) {
+	c := newFakeConn(map[string]string{"/d/a.txt": "hello"})
+	fs := NewConn(c)
+	f, fi, err := fs.OpenStat("/d/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if fi.Name() != "a.txt" || fi.Size() != 5 || fi.IsDir() {
+		t.Fatalf("OpenStat FileInfo = %s %d %t", fi.Name(), fi.Size(), fi.IsDir())
+	}
+	if b, err := io.ReadAll(f); err != nil || string(b) != "hello" {
+		t.Fatalf("read %q, %v; want %q", b, err, "hello")
+	}
+	if n := c.count("LIST"); n != 1 {
+		t.Fatalf("sent %q, want a single LIST", c.sent)
+	}
+	if _, _, err := fs.OpenStat("/d/missing"); err != ErrNotFound {
+		t.Fatalf("OpenStat of a missing file: %v, want ErrNotFound", err)
+	}
+}
+
+// noSizeConn is a flakyConn which refuses SIZE with code.
+type noSizeConn struct {
+	*flakyConn
+	code int
+}
+
+func (c noSizeConn) FileSize(name string) (int64, error) {
+	c.sent = append(c.sent, "SIZE "+name)
+	return 0, &textproto.Error{Code: c.code, Msg: "SIZE not allowed"}
+}
+
+func TestNoSize(t *testing.T) {
+	files := map[string]string{"/a.txt": "0123456789", "/b.txt": "abcdef"}
+	for _, code := range []int{502, 550} {
+		c := noSizeConn{&flakyConn{fakeConn: newFakeConn(files), cut: 4}, code}
+		fs := NewConn(c)
+		fs.VerifySize = true
+
+		// the LIST size is used to seek relative to the end
+		f, err := fs.Open("/a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := f.Seek(-3, io.SeekEnd); n != 7 || err != nil {
+			t.Fatalf("SIZE %d: Seek(-3, io.SeekEnd) = %d, %v; want 7", code, n, err)
+		}
+		f.Seek(0, io.SeekStart)
+		// a transfer is not verified against an unconfirmed size
+		if b, err := io.ReadAll(f); err != nil || string(b) != "0123" {
+			t.Fatalf("SIZE %d: read %q, %v; want the cut stream", code, b, err)
+		}
+		f.Close()
+
+		w := serve(&Handler{FS: fs}, "GET", "/b.txt", "Range: bytes=-2")
+		if w.Code != http.StatusPartialContent || w.Body.String() != "ef" {
+			t.Fatalf("SIZE %d: range of the end: %d %q, want 206 %q", code, w.Code, w.Body, "ef")
+		}
+
+		f, err = fs.Open("/b.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := f.Seek(0, io.SeekEnd); n != 6 || err != nil {
+			t.Fatalf("SIZE %d: Seek(0, io.SeekEnd) = %d, %v; want 6", code, n, err)
+		}
+		f.Close()
+		want := 2
+		if code == 502 {
+			// not asked again once not implemented
+			want = 1
+		}
+		if n := c.count("SIZE"); n != want {
+			t.Fatalf("SIZE %d: sent %q, want %d SIZE", code, c.sent, want)
+		}
+	}
+}
+
+func TestOpenReadSeeker(t *testing.T) {
+	fs := NewConn(newFakeConn(map[string]string{"/d/a.txt": "0123456789"}))
+	r, err := fs.OpenReadSeeker("/d/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if n, err := r.Seek(-4, io.SeekEnd); n != 6 || err != nil {
+		t.Fatalf("Seek(-4, io.SeekEnd) = %d, %v; want 6", n, err)
+	}
+	if b, err := io.ReadAll(r); err != nil || string(b) != "6789" {
+		t.Fatalf("read %q, %v; want %q", b, err, "6789")
+	}
+	if _, err := fs.OpenReadSeeker("/d"); err != ErrReadDir {
+		t.Fatalf("OpenReadSeeker of a directory: %v, want ErrReadDir", err)
+	}
+}
+
+func TestHomeRoot(t *testing.T) {
+	files := map[string]string{"/home/user/x": "home", "/x": "root"}
+	read := func(fs *FS, name string) string {
+		t.Helper()
+		f, err := fs.Open(name)
+		if err != nil {
+			t.Fatalf("Open(%q): %v", name, err)
+		}
+		defer f.Close()
+		b, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	c := newFakeConn(files)
+	c.cwd = "/home/user"
+	fs := NewConn(c)
+	if got := read(fs, "/x"); got != "root" {
+		t.Fatalf("/x is %q by default, want the one at the server root", got)
+	}
+
+	c = newFakeConn(files)
+	c.cwd = "/home/user"
+	fs = NewConn(c)
+	fs.HomeRoot = true
+	for _, name := range []string{"/x", "/../x", "x"} {
+		if got := read(fs, name); got != "home" {
+			t.Errorf("%s is %q with HomeRoot, want /home/user/x", name, got)
+		}
+	}
+	if c.sent[1] != "LIST /home/user/x" {
+		t.Fatalf("sent %q, want LIST /home/user/x", c.sent)
+	}
+
+	// the working directory is given back under the home directory too
+	c = newFakeConn(map[string]string{"/home/user/d/x": "d"})
+	c.cwd = "/home/user"
+	fs = NewConn(c)
+	fs.HomeRoot = true
+	if err := fs.ChangeDir("/d"); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := fs.CurrentDir()
+	if err != nil || dir != "/d" {
+		t.Fatalf("CurrentDir = %q, %v; want /d", dir, err)
+	}
+	if got := read(fs, dir+"/x"); got != "d" {
+		t.Fatalf("%s/x is %q, want /home/user/d/x", dir, got)
+	}
+}
+
+func TestStrictTypeDetection(t *testing.T) {
+	// the directory /x holds a single file x, which the heuristic takes
+	// for the file /x
+	files := map[string]string{"/x/x": "x", "/d/a.txt": "a"}
+	c := newFakeConn(files)
+	if _, isDir, err := NewConn(c).OpenType("/x"); err != nil || isDir {
+		t.Fatalf("OpenType(/x) = %t, %v; want the heuristic's file", isDir, err)
+	}
+	if c.count("CWD") != 0 {
+		t.Fatalf("sent %q, want no CWD without StrictTypeDetection", c.sent)
+	}
+
+	c = newFakeConn(files)
+	fs := NewConn(c)
+	fs.StrictTypeDetection = true
+	if _, isDir, err := fs.OpenType("/x"); err != nil || !isDir {
+		t.Fatalf("OpenType(/x) = %t, %v; want the directory", isDir, err)
+	}
+	if c.count("CWD /x") != 1 {
+		t.Fatalf("sent %q, want CWD /x", c.sent)
+	}
+	if _, isDir, err := fs.OpenType("/d/a.txt"); err != nil || isDir {
+		t.Fatalf("OpenType(/d/a.txt) = %t, %v; want the file", isDir, err)
+	}
+	if c.count("CWD /d/a.txt") != 1 {
+		t.Fatalf("sent %q, want CWD /d/a.txt", c.sent)
+	}
+}
+
+// replyConn is a fakeConn whose commands fail while the reply of a
+// transfer is left unread, that is while a data stream is not closed.
+type replyConn struct {
+	*fakeConn
+	pending *int
+}
+
+var errPendingReply = errors.New("transfer reply not read")
+
+func (c replyConn) List(name string) ([]*ftp.Entry, error) {
+	if *c.pending > 0 {
+		return nil, errPendingReply
+	}
+	return c.fakeConn.List(name)
+}
+
+func (c replyConn) RetrFrom(name string, offset uint64) (io.ReadCloser, error) {
+	if *c.pending > 0 {
+		return nil, errPendingReply
+	}
+	rc, err := c.fakeConn.RetrFrom(name, offset)
+	if err != nil {
+		return nil, err
+	}
+	*c.pending++
+	return replyStream{rc, c.pending}, nil
+}
+
+type replyStream struct {
+	io.ReadCloser
+	pending *int
+}
+
+func (s replyStream) Close() error {
+	*s.pending--
+	return s.ReadCloser.Close()
+}
+
+func TestTransferReply(t *testing.T) {
+	var pending int
+	fs := NewConn(replyConn{newFakeConn(map[string]string{"/d/a.txt": "0123456789", "/d/b.txt": "b"}), &pending})
+	f, err := fs.Open("/d/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the reply is read at the end of the data, before Close
+	if b, err := io.ReadAll(f); err != nil || string(b) != "0123456789" || pending != 0 {
+		t.Fatalf("read %q, %v; %d transfers pending", b, err, pending)
+	}
+	if _, err := fs.Open("/d"); err != nil {
+		t.Fatalf("Open after a read to the end: %v", err)
+	}
+	if err := f.Close(); err != nil || pending != 0 {
+		t.Fatalf("Close: %v, %d transfers pending", err, pending)
+	}
+
+	// or by Close, for a file not read to the end
+	f, err = fs.Open("/d/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Read(make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	d, err := fs.Open("/d")
+	if err != nil {
+		t.Fatalf("Open after Close: %v", err)
+	}
+	if fi, err := d.Readdir(0); err != nil || names(fi) != "a.txt b.txt" {
+		t.Fatalf("Readdir = %v, %v", fi, err)
+	}
+}
+
+func TestReadBufferSizes(t *testing.T) {
+	data := testData(30000)
+	for _, size := range []int{512, 1024, 8192} {
+		c := newFakeConn(map[string]string{"/f": data})
+		f, err := NewConn(c).Open("/f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, size)
+		for i := 0; i < 3; i++ {
+			if _, err := io.ReadFull(f, b); err != nil {
+				t.Fatal(err)
+			}
+			if want := data[i*size : (i+1)*size]; string(b) != want {
+				t.Fatalf("%d bytes buffer: read #%d is wrong", size, i+1)
+			}
+		}
+		// the last bufLen bytes read are kept
+		start := int64(3*size - bufLen)
+		for _, tt := range []struct {
+			pos   int64
+			retrs int
+		}{
+			{start, 1},
+			{int64(3*size) - 1, 1},
+			{start - 1, 2},
+		} {
+			f.Seek(tt.pos, io.SeekStart)
+			b := make([]byte, 10)
+			if _, err := io.ReadFull(f, b); err != nil {
+				t.Fatal(err)
+			}
+			if want := data[tt.pos : tt.pos+10]; string(b) != want {
+				t.Errorf("%d bytes buffer: read %q at %d, want %q", size, b, tt.pos, want)
+			}
+			if n := c.count("RETR"); n != tt.retrs {
+				t.Errorf("%d bytes buffer: %d RETR after reading at %d, want %d", size, n, tt.pos, tt.retrs)
+			}
+		}
+		f.Close()
+	}
+}
+
+// capConn is a fakeConn whose LIST, with "." and "..", is cut at max
+// entries, as some servers do silently.
+type capConn struct {
+	*fakeConn
+	max int
+}
+
+func (c capConn) List(name string) ([]*ftp.Entry, error) {
+	ls, err := c.fakeConn.List(name)
+	if _, ok := c.dirs[c.abs(name)]; ok {
+		dots := []*ftp.Entry{{Name: ".", Type: ftp.EntryTypeFolder}, {Name: "..", Type: ftp.EntryTypeFolder}}
+		ls = append(dots, ls...)
+	}
+	if len(ls) > c.max {
+		ls = ls[:c.max]
+	}
+	return ls, err
+}
+
+func TestListLimit(t *testing.T) {
+	files := map[string]string{"/small/a": "", "/small/b": ""}
+	for i := 0; i < 10; i++ {
+		files[fmt.Sprintf("/big/%d", i)] = ""
+	}
+	fs := NewConn(capConn{newFakeConn(files), 5})
+	fs.ListLimit = 5
+	for _, tt := range []struct {
+		name      string
+		n         int
+		truncated bool
+	}{
+		{"/big", 3, true},
+		{"/small", 2, false},
+	} {
+		f, err := fs.Open(tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := f.Readdir(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fi) != tt.n || f.(interface{ Truncated() bool }).Truncated() != tt.truncated {
+			t.Errorf("%s: %d entries, Truncated() = %t; want %d, %t", tt.name, len(fi),
+				f.(interface{ Truncated() bool }).Truncated(), tt.n, tt.truncated)
+		}
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	c := newFakeConn(map[string]string{"/d/a.txt": "0123456789"})
+	fs := NewConn(c)
+	f, err := fs.OpenFile("/d/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if n := f.Size(); n != 10 {
+		t.Fatalf("Size() = %d, want 10", n)
+	}
+	b := make([]byte, 3)
+	if n, err := f.ReadAt(b, 6); n != 3 || err != nil || string(b) != "678" {
+		t.Fatalf("ReadAt(6) = %d, %v, %q; want %q", n, err, b, "678")
+	}
+	// ReadAt leaves the offset of Read alone
+	if _, err := io.ReadFull(f, b); err != nil || string(b) != "012" {
+		t.Fatalf("Read after ReadAt = %q, %v; want %q", b, err, "012")
+	}
+	var w strings.Builder
+	if n, err := f.WriteTo(&w); n != 7 || err != nil || w.String() != "3456789" {
+		t.Fatalf("WriteTo = %d, %v, %q; want the rest of the file", n, err, w.String())
+	}
+	if _, err := fs.OpenFile("/d"); err != ErrReadDir {
+		t.Fatalf("OpenFile of a directory: %v, want ErrReadDir", err)
+	}
+}
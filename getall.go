@@ -0,0 +1,122 @@
+package ftpfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// GetAll retrieves the files names, each to the writer dst returns for
+// it, over up to concurrency connections at a time: fs and clones of it,
+// see Clone. With a FS made by New or NewConn, or if a clone can not
+// connect, fewer connections are used. dst is called from several
+// goroutines, only for files which could be opened.
+//
+// The returned error joins the errors of every file which failed, each
+// prefixed by its name; the other files are still retrieved.
+func (fs *FS) GetAll(names []string, dst func(name string) (io.Writer, error), concurrency int) error {
+	return fs.GetAllContext(context.Background(), names, dst, concurrency)
+}
+
+// GetAllContext is like GetAll, but starts no more files once ctx is
+// done; those fail with the error of ctx. Files already started are
+// retrieved to the end.
+func (fs *FS) GetAllContext(ctx context.Context, names []string, dst func(name string) (io.Writer, error), concurrency int) error {
+	// clones start in the login directory, not in the working one
+	paths := make([]string, len(names))
+	fs.mu.Lock()
+	for i, name := range names {
+		p, err := fs.abs(name)
+		if err != nil {
+			fs.mu.Unlock()
+			return err
+		}
+		paths[i] = fs.unroot(p)
+	}
+	fs.mu.Unlock()
+
+	errs := fs.parallel(ctx, len(paths), concurrency, func(c *FS, i int) error {
+		return c.get(paths[i], names[i], dst)
+	})
+	for i, err := range errs {
+		if err != nil {
+			errs[i] = fmt.Errorf("%s: %w", names[i], err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// parallel calls do for each of n jobs, over up to concurrency
+// connections: fs and clones of it. It returns the error of each job,
+// the error of ctx for jobs not started before it is done.
+func (fs *FS) parallel(ctx context.Context, n, concurrency int, do func(c *FS, i int) error) []error {
+	if concurrency > n {
+		concurrency = n
+	}
+	conns, done := fs.clones(concurrency)
+	defer done()
+
+	errs := make([]error, n)
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *FS) {
+			defer wg.Done()
+			for i := range jobs {
+				if err := ctx.Err(); err != nil {
+					errs[i] = err
+					continue
+				}
+				errs[i] = do(c, i)
+			}
+		}(c)
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return errs
+}
+
+// clones returns fs and clones of it, up to concurrency connections, or
+// fewer if a clone can not connect. done closes the clones.
+func (fs *FS) clones(concurrency int) (conns []*FS, done func()) {
+	conns = []*FS{fs}
+	for len(conns) < concurrency {
+		c, err := fs.Clone()
+		if err != nil {
+			break
+		}
+		conns = append(conns, c)
+	}
+	return conns, func() {
+		for _, c := range conns[1:] {
+			c.Close()
+		}
+	}
+}
+
+// get retrieves the file at p to the writer dst returns for name.
+func (fs *FS) get(p, name string, dst func(name string) (io.Writer, error)) error {
+	f, err := fs.OpenFile(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w, err := dst(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,80 @@
+package ftpfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestGetAll(t *testing.T) {
+	files := make(map[string]string)
+	var names []string
+	for i := 0; i < 5; i++ {
+		files[fmt.Sprintf("/d/f%d", i)] = strings.Repeat(fmt.Sprint(i), 100)
+		names = append(names, fmt.Sprintf("f%d", i))
+	}
+	dials := 0
+	cfg := Config{Dial: func(string, *Config) (Conn, error) {
+		dials++
+		return newFakeConn(files), nil
+	}}
+	fs, err := DialWithConfig("ftp.example.com:21", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// relative names are resolved against the working directory of fs
+	if err := fs.ChangeDir("/d"); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	got := make(map[string]*bytes.Buffer)
+	dst := func(name string) (io.Writer, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		b := new(bytes.Buffer)
+		got[name] = b
+		return b, nil
+	}
+	err = fs.GetAll(append(names, "missing"), dst, 3)
+	if !errors.Is(err, ErrNotFound) || !strings.HasPrefix(err.Error(), "missing: ") {
+		t.Fatalf("GetAll with a missing file: %v, want its ErrNotFound", err)
+	}
+	for _, name := range names {
+		if b := got[name]; b == nil || b.String() != files["/d/"+name] {
+			t.Errorf("%s: got %v, want its content", name, b)
+		}
+	}
+	if dials != 3 {
+		t.Fatalf("dialed %d connections, want 3", dials)
+	}
+}
+
+func TestGetAllContext(t *testing.T) {
+	files := map[string]string{"/f0": "0", "/f1": "1", "/f2": "2"}
+	c := newFakeConn(files)
+	fs := NewConn(c)
+	ctx, cancel := context.WithCancel(context.Background())
+	var got []string
+	dst := func(name string) (io.Writer, error) {
+		// no more files are started once canceled
+		got = append(got, name)
+		cancel()
+		return io.Discard, nil
+	}
+	err := fs.GetAllContext(ctx, []string{"/f0", "/f1", "/f2"}, dst, 1)
+	if len(got) != 1 || got[0] != "/f0" {
+		t.Fatalf("retrieved %q, want /f0 only", got)
+	}
+	if !errors.Is(err, context.Canceled) || !strings.Contains(err.Error(), "/f1: ") || !strings.Contains(err.Error(), "/f2: ") {
+		t.Fatalf("GetAllContext = %v, want context.Canceled for /f1 and /f2", err)
+	}
+	if n := c.count("RETR"); n != 1 {
+		t.Fatalf("sent %q, want a single RETR", c.sent)
+	}
+}
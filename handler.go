@@ -0,0 +1,335 @@
+package ftpfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Handler serves the files of FS over HTTP, like http.FileServer.
+type Handler struct {
+	FS http.FileSystem
+
+	// DisableDirListing answers 404 Not Found for directories instead of
+	// listing them. Files are still served.
+	DisableDirListing bool
+
+	// Gzip serves name.gz with Content-Encoding: gzip for a request of
+	// name, if the client accepts gzip and name.gz exists.
+	Gzip bool
+
+	// NotFound, if not nil, serves the requests of names which are not
+	// found, instead of the plain 404 Not Found of http.FileServer.
+	NotFound http.Handler
+
+	// IndexFiles are the names of files served for a directory, if one
+	// exists in it, in order of preference, e.g. "index.html". The
+	// directory is listed if none does.
+	IndexFiles []string
+}
+
+// ServeHTTP serves the request like http.FileServer. A file whose type is
+// not known by its extension is served as application/octet-stream,
+// instead of sniffing its content, so a HEAD request does not retrieve
+// any file data, and has the headers of a GET: the size is the one
+// listed.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fs := h.FS
+	if h.DisableDirListing {
+		fs = noDirs{fs}
+	}
+	if h.Gzip {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) && serveGzip(w, r, fs) {
+			return
+		}
+	}
+	fs = untypedFS{fs, w}
+	if len(h.IndexFiles) > 0 && strings.HasSuffix(r.URL.Path, "/") &&
+		serveIndex(w, r, fs, h.IndexFiles) {
+		return
+	}
+	if h.NotFound != nil {
+		name := path.Clean("/" + r.URL.Path)
+		f, err := fs.Open(name)
+		if errors.Is(err, os.ErrNotExist) {
+			h.NotFound.ServeHTTP(w, r)
+			return
+		}
+		if err == nil {
+			o := &openedFS{fs, name, f}
+			defer o.close()
+			fs = o
+		}
+	}
+	http.FileServer(fs).ServeHTTP(w, r)
+}
+
+// serveGzip serves the gzip variant of the requested file, and reports
+// whether there is one.
+func serveGzip(w http.ResponseWriter, r *http.Request, fs http.FileSystem) bool {
+	if strings.HasSuffix(r.URL.Path, "/") {
+		return false
+	}
+	name := path.Clean("/" + r.URL.Path)
+	f, err := fs.Open(name + ".gz")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		return false
+	}
+
+	// do not let ServeContent sniff the compressed data
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Encoding", "gzip")
+	http.ServeContent(w, r, name, fi.ModTime(), f)
+	return true
+}
+
+// serveIndex serves the first of index which is a file in the requested
+// directory, and reports whether there is one.
+func serveIndex(w http.ResponseWriter, r *http.Request, fs http.FileSystem, index []string) bool {
+	dir := path.Clean("/" + r.URL.Path)
+	for _, name := range index {
+		f, err := fs.Open(path.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		fi, err := f.Stat()
+		if err != nil || fi.IsDir() {
+			f.Close()
+			continue
+		}
+		defer f.Close()
+		http.ServeContent(w, r, name, fi.ModTime(), f)
+		return true
+	}
+	return false
+}
+
+// acceptsGzip reports whether the client accepts gzip encoding.
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc, params, _ := strings.Cut(v, ";")
+		if strings.TrimSpace(enc) != "gzip" {
+			continue
+		}
+		// "gzip;q=0" refuses it
+		return strings.ReplaceAll(params, " ", "") != "q=0"
+	}
+	return false
+}
+
+// openedFS hands out a file opened already for its first Open of name,
+// so it is not looked up twice.
+type openedFS struct {
+	http.FileSystem
+	name string
+	f    http.File
+}
+
+func (o *openedFS) Open(name string) (http.File, error) {
+	if f := o.f; f != nil && name == o.name {
+		o.f = nil
+		return f, nil
+	}
+	return o.FileSystem.Open(name)
+}
+
+// close closes the file if it was not handed out, e.g. for a redirect.
+func (o *openedFS) close() {
+	if o.f != nil {
+		o.f.Close()
+	}
+}
+
+// untypedFS sets Content-Type: application/octet-stream for the files it
+// opens whose type is not known by their extension, so http.FileServer
+// does not sniff them.
+type untypedFS struct {
+	http.FileSystem
+	w http.ResponseWriter
+}
+
+func (u untypedFS) Open(name string) (http.File, error) {
+	f, err := u.FileSystem.Open(name)
+	if err != nil || mime.TypeByExtension(path.Ext(name)) != "" {
+		return f, err
+	}
+	if fi, err := f.Stat(); err == nil && !fi.IsDir() && u.w.Header().Get("Content-Type") == "" {
+		u.w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	return f, nil
+}
+
+// noDirs hides the directories of a http.FileSystem.
+type noDirs struct {
+	http.FileSystem
+}
+
+func (n noDirs) Open(name string) (http.File, error) {
+	f, err := n.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, ErrNotFound
+	}
+	return f, nil
+}
+
+// StripPrefix returns a http.FileSystem which opens the names given to it
+// in fs without prefix, for a FS served under a URL prefix without
+// http.StripPrefix. Names without the prefix are not found. E.g. with
+// prefix "/files", "/files/a.txt" opens "/a.txt".
+func StripPrefix(prefix string, fs http.FileSystem) http.FileSystem {
+	return stripPrefix{fs, strings.TrimSuffix(prefix, "/")}
+}
+
+type stripPrefix struct {
+	http.FileSystem
+	prefix string
+}
+
+func (s stripPrefix) Open(name string) (http.File, error) {
+	rest, ok := strings.CutPrefix(name, s.prefix)
+	if !ok || rest != "" && rest[0] != '/' {
+		return nil, ErrNotFound
+	}
+	return s.FileSystem.Open("/" + strings.TrimPrefix(rest, "/"))
+}
+
+// FileHandler returns a http.Handler which serves the file ftpPath of fs
+// for every request, e.g. to serve the latest build at a fixed URL.
+// Range requests are supported.
+func FileHandler(fs *FS, ftpPath string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, err := fs.OpenFile(ftpPath)
+		if err != nil {
+			serveError(w, err)
+			return
+		}
+		defer f.Close()
+		http.ServeContent(w, r, path.Base(ftpPath), f.entry.ModTime(), f)
+	})
+}
+
+// ServeRange serves the file name of fs, retrieving only the bytes of
+// the Range of the request, from its offset with REST. A request without
+// a Range, or with several ranges, is answered with the whole file.
+func ServeRange(w http.ResponseWriter, r *http.Request, fs *FS, name string) {
+	f, err := fs.OpenFile(name)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	defer f.Close()
+
+	size := f.Size()
+	h := w.Header()
+	h.Set("Accept-Ranges", "bytes")
+	if h.Get("Content-Type") == "" {
+		ctype := mime.TypeByExtension(path.Ext(name))
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		h.Set("Content-Type", ctype)
+	}
+	if mt := f.entry.ModTime(); !mt.IsZero() {
+		h.Set("Last-Modified", mt.UTC().Format(http.TimeFormat))
+	}
+
+	start, n, ok := parseRange(r.Header.Get("Range"), size)
+	status := http.StatusOK
+	switch {
+	case !ok:
+		h.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		http.Error(w, "416 Requested Range Not Satisfiable", http.StatusRequestedRangeNotSatisfiable)
+		return
+	case n < size:
+		status = http.StatusPartialContent
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+n-1, size))
+	}
+	h.Set("Content-Length", strconv.FormatInt(n, 10))
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return
+	}
+	// the rest of the transfer is aborted by Close
+	io.CopyN(w, f, n)
+}
+
+// parseRange returns the offset and length of the single byte range of
+// the Range header s, for a file of size bytes. The whole file is
+// returned for no or several ranges, and ok is false for a range which
+// can not be satisfied.
+func parseRange(s string, size int64) (start, n int64, ok bool) {
+	spec, found := strings.CutPrefix(s, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, size, true
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, size, true
+	}
+	if first == "" {
+		// the last bytes, of which an empty file has none
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, true
+}
+
+// serveError replies to the request with the HTTP status matching err.
+func serveError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		http.Error(w, "404 page not found", http.StatusNotFound)
+	case errors.Is(err, os.ErrPermission):
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+	default:
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+	}
+}
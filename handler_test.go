@@ -0,0 +1,270 @@
+package ftpfs
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// serve returns the response of h to a request of target, with the
+// header lines given as "name: value".
+func serve(h http.Handler, method, target string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for _, line := range header {
+		k, v, _ := strings.Cut(line, ": ")
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestServeContentOneRetr(t *testing.T) {
+	c := newFakeConn(map[string]string{"/a.txt": "0123456789"})
+	fs := NewConn(c)
+	f, err := fs.Open("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r := httptest.NewRequest("GET", "/a.txt", nil)
+	r.Header.Set("Range", "bytes=5-")
+	w := httptest.NewRecorder()
+	http.ServeContent(w, r, "a.txt", fakeTime, f)
+	if w.Code != http.StatusPartialContent || w.Body.String() != "56789" {
+		t.Fatalf("got %d %q, want 206 %q", w.Code, w.Body, "56789")
+	}
+	if n := c.count("RETR"); n != 1 {
+		t.Fatalf("%d RETR sent, want 1", n)
+	}
+	if got, want := c.sent[len(c.sent)-2], "REST 5"; got != want {
+		t.Fatalf("RETR after %q, want %q", got, want)
+	}
+}
+
+func TestDisableDirListing(t *testing.T) {
+	h := &Handler{
+		FS:                NewConn(newFakeConn(map[string]string{"/d/a.txt": "hello"})),
+		DisableDirListing: true,
+	}
+	if w := serve(h, "GET", "/d/"); w.Code != http.StatusNotFound {
+		t.Errorf("GET of a directory: %d, want 404", w.Code)
+	}
+	if w := serve(h, "GET", "/d/a.txt"); w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("GET of a file: %d %q, want 200 %q", w.Code, w.Body, "hello")
+	}
+}
+
+func TestServeContentRange(t *testing.T) {
+	fs := NewConn(newFakeConn(map[string]string{"/a.txt": "0123456789"}))
+	w := serve(&Handler{FS: fs}, "GET", "/a.txt", "Range: bytes=2-5")
+	if w.Code != http.StatusPartialContent || w.Body.String() != "2345" {
+		t.Fatalf("got %d %q, want 206 %q", w.Code, w.Body, "2345")
+	}
+	if got, want := w.Header().Get("Content-Range"), "bytes 2-5/10"; got != want {
+		t.Fatalf("Content-Range %q, want %q", got, want)
+	}
+
+	f, err := fs.Open("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := f.Seek(-3, io.SeekEnd); n != 7 || err != nil {
+		t.Fatalf("Seek(-3, io.SeekEnd) = %d, %v; want 7", n, err)
+	}
+	if n, err := f.Seek(-8, io.SeekCurrent); n != 7 || !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("Seek(-8, io.SeekCurrent) = %d, %v; want 7 and os.ErrInvalid", n, err)
+	}
+}
+
+func TestFileHandler(t *testing.T) {
+	h := FileHandler(NewConn(newFakeConn(map[string]string{"/reports/2020.pdf": "0123456789"})), "/reports/2020.pdf")
+	w := serve(h, "GET", "/latest.pdf")
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Fatalf("GET: %d %q", w.Code, w.Body)
+	}
+	for k, want := range map[string]string{
+		"Content-Type":   "application/pdf",
+		"Content-Length": "10",
+		"Last-Modified":  fakeTime.Format(http.TimeFormat),
+	} {
+		if got := w.Header().Get(k); got != want {
+			t.Errorf("%s: %q, want %q", k, got, want)
+		}
+	}
+
+	w = serve(h, "GET", "/latest.pdf", "Range: bytes=4-")
+	if w.Code != http.StatusPartialContent || w.Body.String() != "456789" {
+		t.Fatalf("ranged GET: %d %q, want 206 %q", w.Code, w.Body, "456789")
+	}
+}
+
+func TestGzip(t *testing.T) {
+	h := &Handler{
+		FS: NewConn(newFakeConn(map[string]string{
+			"/app.js":    "plain",
+			"/app.js.gz": "gzipped",
+			"/lib.js":    "lib",
+		})),
+		Gzip: true,
+	}
+	for _, tt := range []struct {
+		target, accept, body, encoding string
+	}{
+		{"/app.js", "gzip, deflate", "gzipped", "gzip"},
+		{"/app.js", "", "plain", ""},
+		{"/app.js", "gzip;q=0", "plain", ""},
+		{"/lib.js", "gzip", "lib", ""},
+	} {
+		w := serve(h, "GET", tt.target, "Accept-Encoding: "+tt.accept)
+		if w.Code != http.StatusOK || w.Body.String() != tt.body {
+			t.Errorf("GET %s, accepting %q: %d %q, want 200 %q", tt.target, tt.accept, w.Code, w.Body, tt.body)
+		}
+		if got := w.Header().Get("Content-Encoding"); got != tt.encoding {
+			t.Errorf("GET %s, accepting %q: Content-Encoding %q, want %q", tt.target, tt.accept, got, tt.encoding)
+		}
+		if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/javascript") {
+			t.Errorf("GET %s, accepting %q: Content-Type %q", tt.target, tt.accept, got)
+		}
+	}
+}
+
+func TestStripPrefix(t *testing.T) {
+	c := newFakeConn(map[string]string{"/a.txt": "a"})
+	h := http.FileServer(StripPrefix("/files/", NewConn(c)))
+	if w := serve(h, "GET", "/files/a.txt"); w.Code != http.StatusOK || w.Body.String() != "a" {
+		t.Errorf("GET with the prefix: %d %q, want 200 %q", w.Code, w.Body, "a")
+	}
+	if c.count("LIST /a.txt") != 1 {
+		t.Errorf("sent %q, want LIST /a.txt", c.sent)
+	}
+	for _, target := range []string{"/a.txt", "/filesa.txt", "/other/a.txt"} {
+		if w := serve(h, "GET", target); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s without the prefix: %d, want 404", target, w.Code)
+		}
+	}
+	if w := serve(h, "GET", "/files/"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "a.txt") {
+		t.Errorf("GET of the prefix: %d %q, want the root listing", w.Code, w.Body)
+	}
+}
+
+func TestHead(t *testing.T) {
+	c := newFakeConn(map[string]string{"/a.txt": "0123456789", "/data": "0123456789"})
+	h := &Handler{FS: NewConn(c)}
+	for _, target := range []string{"/a.txt", "/data"} {
+		w := serve(h, "HEAD", target)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Length") != "10" {
+			t.Errorf("HEAD %s: %d, Content-Length %q; want 200, 10", target, w.Code, w.Header().Get("Content-Length"))
+		}
+	}
+	if n := c.count("RETR"); n != 0 {
+		t.Fatalf("sent %q, want no RETR for HEAD", c.sent)
+	}
+	if ct := serve(h, "HEAD", "/data").Header().Get("Content-Type"); ct != "application/octet-stream" {
+		t.Fatalf("HEAD of an unknown type: Content-Type %q, want application/octet-stream", ct)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	c := newFakeConn(map[string]string{"/a.txt": "a"})
+	var got *http.Request
+	h := &Handler{
+		FS: NewConn(c),
+		NotFound: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = r
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "custom 404")
+		}),
+	}
+	w := serve(h, "GET", "/missing.txt?q=1")
+	if w.Code != http.StatusNotFound || w.Body.String() != "custom 404" {
+		t.Fatalf("GET of a missing file: %d %q, want the custom 404", w.Code, w.Body)
+	}
+	if got == nil || got.URL.RawQuery != "q=1" {
+		t.Fatalf("NotFound got %v, want the original request", got)
+	}
+
+	got = nil
+	w = serve(h, "GET", "/a.txt")
+	if w.Code != http.StatusOK || w.Body.String() != "a" || got != nil {
+		t.Fatalf("GET of a file: %d %q, NotFound called: %t", w.Code, w.Body, got != nil)
+	}
+	if n := c.count("LIST /a.txt"); n != 1 {
+		t.Fatalf("sent %q, want the file looked up once", c.sent)
+	}
+}
+
+func TestIndexFiles(t *testing.T) {
+	fs := NewConn(newFakeConn(map[string]string{
+		"/site/index.htm":  "old",
+		"/site/index.html": "<h1>home</h1>",
+		"/files/a.txt":     "a",
+	}))
+	h := &Handler{FS: fs, IndexFiles: []string{"index.html", "index.htm"}}
+
+	w := serve(h, "GET", "/site/")
+	if w.Code != http.StatusOK || w.Body.String() != "<h1>home</h1>" {
+		t.Fatalf("GET /site/: %d %q, want index.html", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Fatalf("GET /site/: Content-Type %q, want text/html", ct)
+	}
+
+	w = serve(h, "GET", "/files/")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `<a href="a.txt">a.txt</a>`) {
+		t.Fatalf("GET /files/: %d %q, want the listing", w.Code, w.Body)
+	}
+}
+
+func TestServeRange(t *testing.T) {
+	for _, tt := range []struct {
+		rng     string
+		code    int
+		body    string
+		crange  string
+		restart string
+	}{
+		{"bytes=2-5", http.StatusPartialContent, "2345", "bytes 2-5/10", "REST 2"},
+		{"bytes=-3", http.StatusPartialContent, "789", "bytes 7-9/10", "REST 7"},
+		{"bytes=8-", http.StatusPartialContent, "89", "bytes 8-9/10", "REST 8"},
+		{"", http.StatusOK, "0123456789", "", ""},
+		{"bytes=0-1,4-5", http.StatusOK, "0123456789", "", ""},
+		{"bytes=20-", http.StatusRequestedRangeNotSatisfiable, "", "bytes */10", ""},
+	} {
+		c := sizeConn{newFakeConn(map[string]string{"/a.txt": "0123456789"})}
+		fs := NewConn(c)
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ServeRange(w, r, fs, r.URL.Path)
+		})
+		var w *httptest.ResponseRecorder
+		if tt.rng == "" {
+			w = serve(h, "GET", "/a.txt")
+		} else {
+			w = serve(h, "GET", "/a.txt", "Range: "+tt.rng)
+		}
+		if w.Code != tt.code || w.Header().Get("Content-Range") != tt.crange {
+			t.Errorf("Range %q: %d, Content-Range %q; want %d, %q", tt.rng, w.Code, w.Header().Get("Content-Range"), tt.code, tt.crange)
+			continue
+		}
+		if tt.code == http.StatusRequestedRangeNotSatisfiable {
+			continue
+		}
+		if w.Body.String() != tt.body {
+			t.Errorf("Range %q: body %q, want %q", tt.rng, w.Body, tt.body)
+		}
+		var restart []string
+		for _, cmd := range c.sent {
+			if strings.HasPrefix(cmd, "REST ") {
+				restart = append(restart, cmd)
+			}
+		}
+		if strings.Join(restart, " ") != tt.restart {
+			t.Errorf("Range %q: sent %q, want a RETR from the range start", tt.rng, c.sent)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build go1.22
+
+package ftpfs
+
+import "net/http"
+
+// HandlerFS returns http.FileServerFS serving the IOFS view of fs, for
+// users who prefer the standard file server to Handler. It requires Go
+// 1.22 or later.
+func HandlerFS(fs *FS) http.Handler {
+	return http.FileServerFS(fs.IOFS())
+}
@@ -0,0 +1,27 @@
+//go:build go1.22
+
+package ftpfs
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHandlerFS(t *testing.T) {
+	h := HandlerFS(NewConn(newFakeConn(map[string]string{"/d/a.txt": "hello"})))
+	w := serve(h, "GET", "/d/a.txt")
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Fatalf("GET /d/a.txt: %d %q, want 200 %q", w.Code, w.Body, "hello")
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("Content-Type %q, want text/plain", ct)
+	}
+	w = serve(h, "GET", "/d/")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `<a href="a.txt">a.txt</a>`) {
+		t.Fatalf("GET /d/: %d %q, want the listing", w.Code, w.Body)
+	}
+	if w := serve(h, "GET", "/d/missing"); w.Code != http.StatusNotFound {
+		t.Fatalf("GET of a missing file: %d, want 404", w.Code)
+	}
+}
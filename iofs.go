@@ -0,0 +1,119 @@
+package ftpfs
+
+import (
+	"io"
+	iofs "io/fs"
+	"net/http"
+	"path"
+)
+
+// IOFS returns an io/fs.FS view of fs, with names resolved from the FTP
+// root. Directories opened from it implement fs.ReadDirFile, so it can
+// be used with fs.WalkDir.
+func (fs *FS) IOFS() iofs.FS {
+	return ioFS{fs: fs}
+}
+
+// ioFS implements fs.FS, fs.ReadDirFS, fs.StatFS and fs.SubFS
+type ioFS struct {
+	fs   *FS
+	root string // FTP directory names are relative to, "" for the FTP root
+}
+
+// ftpPath maps a io/fs name to a FTP path.
+func (f ioFS) ftpPath(name string) string {
+	return path.Join("/", f.root, name)
+}
+
+func (f ioFS) open(op, name string) (http.File, error) {
+	if !iofs.ValidPath(name) {
+		return nil, &iofs.PathError{Op: op, Path: name, Err: iofs.ErrInvalid}
+	}
+	file, err := f.fs.Open(f.ftpPath(name))
+	if err != nil {
+		if err == ErrNotFound {
+			err = iofs.ErrNotExist
+		}
+		return nil, &iofs.PathError{Op: op, Path: name, Err: err}
+	}
+	if d, ok := file.(*ftpDir); ok {
+		return ioDir{d, f, name}, nil
+	}
+	return file, nil
+}
+
+// ioDir is a directory opened from an ioFS. Its Stat is the one of the
+// ioFS, so it agrees with the entry of its parent directory, as io/fs
+// requires.
+type ioDir struct {
+	*ftpDir
+	fsys ioFS
+	name string
+}
+
+func (d ioDir) Stat() (iofs.FileInfo, error) {
+	return d.fsys.Stat(d.name)
+}
+
+func (f ioFS) Open(name string) (iofs.File, error) {
+	return f.open("open", name)
+}
+
+func (f ioFS) ReadDir(name string) ([]iofs.DirEntry, error) {
+	file, err := f.open("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	d, ok := file.(iofs.ReadDirFile)
+	if !ok {
+		return nil, &iofs.PathError{Op: "readdir", Path: name, Err: ErrReadFile}
+	}
+	return d.ReadDir(-1)
+}
+
+func (f ioFS) Stat(name string) (iofs.FileInfo, error) {
+	if !iofs.ValidPath(name) {
+		return nil, &iofs.PathError{Op: "stat", Path: name, Err: iofs.ErrInvalid}
+	}
+	fi, err := f.fs.Stat(f.ftpPath(name))
+	if err != nil {
+		if err == ErrNotFound {
+			err = iofs.ErrNotExist
+		}
+		return nil, &iofs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return fi, nil
+}
+
+// Sub returns the file system rooted at dir. As dir and all names must be
+// valid io/fs paths, names can not escape dir.
+func (f ioFS) Sub(dir string) (iofs.FS, error) {
+	if !iofs.ValidPath(dir) {
+		return nil, &iofs.PathError{Op: "sub", Path: dir, Err: iofs.ErrInvalid}
+	}
+	if dir == "." {
+		return f, nil
+	}
+	return ioFS{fs: f.fs, root: path.Join(f.root, dir)}, nil
+}
+
+// ReadDir implements fs.ReadDirFile. Entries are sorted by name.
+func (d *ftpDir) ReadDir(n int) ([]iofs.DirEntry, error) {
+	fi := d.fi[d.off:]
+	if n > 0 {
+		if len(fi) == 0 {
+			return nil, io.EOF
+		}
+		if n < len(fi) {
+			fi = fi[:n]
+		}
+	}
+	d.off += len(fi)
+
+	b := make([]iofs.DirEntry, len(fi))
+	for i, v := range fi {
+		b[i] = iofs.FileInfoToDirEntry(v)
+	}
+	return b, nil
+}
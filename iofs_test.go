@@ -0,0 +1,65 @@
+package ftpfs
+
+import (
+	"errors"
+	iofs "io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestIOFSWalkDir(t *testing.T) {
+	fs := NewConn(newFakeConn(map[string]string{
+		"/a.txt":       "a",
+		"/d/b.txt":     "b",
+		"/d/e/c.txt":   "c",
+		"/d/empty/":    "",
+		"/d/e/f/d.txt": "d",
+	}))
+	var walked []string
+	err := iofs.WalkDir(fs.IOFS(), ".", func(p string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		walked = append(walked, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ". a.txt d d/b.txt d/e d/e/c.txt d/e/f d/e/f/d.txt d/empty"
+	if got := strings.Join(walked, " "); got != want {
+		t.Fatalf("walked %q, want %q", got, want)
+	}
+
+	if err := fstest.TestFS(fs.IOFS(), "a.txt", "d/b.txt", "d/e/f/d.txt", "d/empty"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIOFSSub(t *testing.T) {
+	c := newFakeConn(map[string]string{"/a.txt": "a", "/d/b.txt": "b"})
+	fsys := NewConn(c).IOFS()
+	if _, err := iofs.Sub(fsys, "../d"); err == nil {
+		t.Error("Sub of ../d: no error")
+	}
+	sub, err := iofs.Sub(fsys, "d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := iofs.ReadFile(sub, "b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "b" {
+		t.Fatalf("read %q, want %q", b, "b")
+	}
+	if got, want := c.sent[0], "LIST /d/b.txt"; got != want {
+		t.Fatalf("sent %q, want %q", got, want)
+	}
+	for _, name := range []string{"../a.txt", "/a.txt", "x/../../a.txt"} {
+		if _, err := sub.Open(name); !errors.Is(err, iofs.ErrInvalid) {
+			t.Errorf("Open(%q) in sub: %v, want ErrInvalid", name, err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package ftpfs
+
+import (
+	"bytes"
+	"io"
+	"net/textproto"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/goftp/ftp"
+)
+
+// NewMemFS returns a FS serving files from memory instead of a FTP
+// server, intended for tests of code using a FS or a http.FileSystem.
+// files maps slash separated paths to their content; directories are
+// implied by the paths, and a path ending in "/" is a directory which may
+// be empty. All entries have the time NewMemFS is called.
+//
+// The FS behaves as with a FTP server which replies 550 to what it can
+// not find, so it returns the same errors.
+func NewMemFS(files map[string][]byte) *FS {
+	c := &memConn{
+		files: make(map[string][]byte),
+		dirs:  map[string]bool{"/": true},
+		time:  time.Now(),
+		cwd:   "/",
+	}
+	for name, b := range files {
+		dir := strings.HasSuffix(name, "/")
+		name = path.Join("/", name)
+		if dir {
+			c.dirs[name] = true
+		} else {
+			c.files[name] = b
+		}
+		for d := path.Dir(name); !c.dirs[d]; d = path.Dir(d) {
+			c.dirs[d] = true
+		}
+	}
+	return NewConn(c)
+}
+
+// memConn implements Conn, and the sizer interface, with files in memory.
+type memConn struct {
+	files map[string][]byte
+	dirs  map[string]bool
+	time  time.Time
+	cwd   string
+}
+
+var errMemNotFound = &textproto.Error{Code: 550, Msg: "No such file or directory"}
+
+func (c *memConn) abs(name string) string {
+	if path.IsAbs(name) {
+		return path.Clean(name)
+	}
+	return path.Join(c.cwd, name)
+}
+
+func (c *memConn) entry(name string) *ftp.Entry {
+	e := &ftp.Entry{Name: path.Base(name), Type: ftp.EntryTypeFolder, Time: c.time}
+	if b, ok := c.files[name]; ok {
+		e.Type = ftp.EntryTypeFile
+		e.Size = uint64(len(b))
+	}
+	return e
+}
+
+// List lists a directory or a file like ls, and nothing for a missing
+// name.
+func (c *memConn) List(name string) ([]*ftp.Entry, error) {
+	name = c.abs(name)
+	if _, ok := c.files[name]; ok {
+		return []*ftp.Entry{c.entry(name)}, nil
+	}
+	var ls []*ftp.Entry
+	if !c.dirs[name] {
+		return ls, nil
+	}
+	for n := range c.files {
+		if path.Dir(n) == name {
+			ls = append(ls, c.entry(n))
+		}
+	}
+	for n := range c.dirs {
+		if n != "/" && path.Dir(n) == name {
+			ls = append(ls, c.entry(n))
+		}
+	}
+	return ls, nil
+}
+
+func (c *memConn) ChangeDir(name string) error {
+	name = c.abs(name)
+	if !c.dirs[name] {
+		return errMemNotFound
+	}
+	c.cwd = name
+	return nil
+}
+
+func (c *memConn) CurrentDir() (string, error) {
+	return c.cwd, nil
+}
+
+func (c *memConn) RetrFrom(name string, offset uint64) (io.ReadCloser, error) {
+	b, ok := c.files[c.abs(name)]
+	if !ok {
+		return nil, errMemNotFound
+	}
+	if offset > uint64(len(b)) {
+		offset = uint64(len(b))
+	}
+	return io.NopCloser(bytes.NewReader(b[offset:])), nil
+}
+
+func (c *memConn) FileSize(name string) (int64, error) {
+	b, ok := c.files[c.abs(name)]
+	if !ok {
+		return 0, errMemNotFound
+	}
+	return int64(len(b)), nil
+}
@@ -0,0 +1,47 @@
+package ftpfs
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestMemFS(t *testing.T) {
+	files := map[string]string{"/d/a.txt": "hello", "/d/e/": ""}
+	mem := make(map[string][]byte)
+	for name, s := range files {
+		mem[name] = []byte(s)
+	}
+	ops := map[string]func(f http.File) string{
+		"read": func(f http.File) string {
+			b, err := io.ReadAll(f)
+			return fmt.Sprintf("%q %v", b, err)
+		},
+		"readdir": func(f http.File) string {
+			fi, err := f.Readdir(0)
+			return fmt.Sprintf("%s %v", names(fi), err)
+		},
+		"seek": func(f http.File) string {
+			n, err := f.Seek(2, io.SeekStart)
+			return fmt.Sprintf("%d %v", n, err)
+		},
+	}
+	// what fs does to name, with an error of Open as is
+	do := func(fs *FS, name, op string) string {
+		f, err := fs.Open(name)
+		if err != nil {
+			return "open " + err.Error()
+		}
+		defer f.Close()
+		return ops[op](f)
+	}
+	for _, name := range []string{"/d", "/d/", "/d/a.txt", "/d/a.txt/", "/d/e", "/d/missing", "/missing/a.txt", "d/a.txt"} {
+		for op := range ops {
+			want := do(NewConn(newFakeConn(files)), name, op)
+			if got := do(NewMemFS(mem), name, op); got != want {
+				t.Errorf("%s of %s: %s, want %s as of a FTP server", op, name, got, want)
+			}
+		}
+	}
+}
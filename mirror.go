@@ -0,0 +1,138 @@
+package ftpfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// MirrorOptions configures Mirror.
+type MirrorOptions struct {
+	// SkipUnchanged does not retrieve a file whose local copy has the same
+	// size and modification time, to the second.
+	SkipUnchanged bool
+
+	// Concurrency is how many files are retrieved at a time, over fs and
+	// clones of it, as with GetAll. Zero means one at a time.
+	Concurrency int
+}
+
+// Mirror copies the directory root of fs and all its content to the local
+// directory localDir, which is created if needed. Files keep their
+// modification time. A file or directory which fails does not stop the
+// mirror: the returned error joins the errors of all, each prefixed by
+// its FTP path. Only an error on root itself stops it at once. Entries
+// whose name would be written outside localDir, like "..", are skipped
+// with ErrInvalid.
+func (fs *FS) Mirror(root, localDir string, opts MirrorOptions) error {
+	fs.mu.Lock()
+	root, err := fs.abs(root)
+	root = fs.unroot(root) // as ioFS opens it again
+	fs.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(localDir, 0755); err != nil {
+		return err
+	}
+
+	type job struct {
+		rel string
+		fi  iofs.FileInfo
+	}
+	var jobs []job
+	var errs []error
+	fsys := ioFS{fs: fs, root: root}
+	err = iofs.WalkDir(fsys, ".", func(rel string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			if rel == "." {
+				return err
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", path.Join(root, rel), err))
+			return iofs.SkipDir
+		}
+		if !iofs.ValidPath(rel) || !filepath.IsLocal(filepath.FromSlash(rel)) {
+			// a name sent by the server, like "..", must not leave localDir
+			errs = append(errs, fmt.Errorf("%q in %s: %w", rel, root, ErrInvalid))
+			if d.IsDir() {
+				return iofs.SkipDir
+			}
+			return nil
+		}
+		local := filepath.Join(localDir, filepath.FromSlash(rel))
+		if d.IsDir() {
+			if err := os.MkdirAll(local, 0755); err != nil {
+				errs = append(errs, err)
+				return iofs.SkipDir
+			}
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path.Join(root, rel), err))
+			return nil
+		}
+		if opts.SkipUnchanged && unchanged(local, fi) {
+			return nil
+		}
+		jobs = append(jobs, job{rel, fi})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ferrs := fs.parallel(context.Background(), len(jobs), opts.Concurrency, func(c *FS, i int) error {
+		j := jobs[i]
+		local := filepath.Join(localDir, filepath.FromSlash(j.rel))
+		return c.mirrorFile(path.Join(root, j.rel), local, j.fi)
+	})
+	for i, err := range ferrs {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path.Join(root, jobs[i].rel), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// unchanged reports whether the local file has the size and modification
+// time of fi.
+func unchanged(local string, fi iofs.FileInfo) bool {
+	lfi, err := os.Stat(local)
+	return err == nil && lfi.Mode().IsRegular() && lfi.Size() == fi.Size() &&
+		lfi.ModTime().Unix() == fi.ModTime().Unix()
+}
+
+// mirrorFile retrieves the file p to local, with the modification time
+// of fi. The local file is written in full or removed.
+func (fs *FS) mirrorFile(p, local string, fi iofs.FileInfo) error {
+	f, err := fs.OpenFile(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w, err := os.Create(local)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		os.Remove(local)
+		return err
+	}
+	if mt := fi.ModTime(); !mt.IsZero() {
+		return os.Chtimes(local, mt, mt)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package ftpfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMirror(t *testing.T) {
+	c := newFakeConn(map[string]string{
+		"/pub/a.txt":     "aaa",
+		"/pub/sub/b.txt": "bb",
+		"/pub/empty/":    "",
+		"/other.txt":     "x",
+	})
+	fs := NewConn(c)
+	dir := t.TempDir()
+	if err := fs.Mirror("/pub", dir, MirrorOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"a.txt": "aaa", "sub/b.txt": "bb"} {
+		local := filepath.Join(dir, filepath.FromSlash(name))
+		b, err := os.ReadFile(local)
+		if err != nil || string(b) != want {
+			t.Errorf("%s: %q, %v; want %q", name, b, err, want)
+			continue
+		}
+		if fi, _ := os.Stat(local); !fi.ModTime().Equal(fakeTime) {
+			t.Errorf("%s: modified %v, want %v", name, fi.ModTime(), fakeTime)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "empty")); err != nil || !fi.IsDir() {
+		t.Errorf("empty: %v, %v; want a directory", fi, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "other.txt")); !os.IsNotExist(err) {
+		t.Errorf("other.txt out of /pub is mirrored: %v", err)
+	}
+
+	// a file changed locally is retrieved again
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("changed"), 0644)
+	c.sent = nil
+	if err := fs.Mirror("/pub", dir, MirrorOptions{SkipUnchanged: true}); err != nil {
+		t.Fatal(err)
+	}
+	if c.count("RETR") != 1 || c.count("RETR /pub/a.txt") != 1 {
+		t.Fatalf("sent %q, want a RETR of the changed file only", c.sent)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(b) != "aaa" {
+		t.Fatalf("a.txt is %q after the mirror, want %q", b, "aaa")
+	}
+
+	// a file which fails does not stop the others
+	delete(c.files, "/pub/sub/b.txt")
+	dir = t.TempDir()
+	err := fs.Mirror("/pub", dir, MirrorOptions{})
+	if err == nil || !strings.HasPrefix(err.Error(), "/pub/sub/b.txt: ") {
+		t.Fatalf("Mirror with a failing file: %v, want its error", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.txt")); err != nil {
+		t.Fatalf("a.txt is not mirrored with another file failing: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package ftpfs
+
+import (
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goftp/ftp"
+)
+
+// entryGetter is implemented by FTP clients which support MLST.
+type entryGetter interface {
+	GetEntry(path string) (*ftp.Entry, error)
+}
+
+// mlst returns the entry of name with MLST. It returns ErrUnsupported if
+// the server or the FTP client does not support MLST.
+func (fs *FS) mlst(name string) (ftpEntry, error) {
+	if fs.noMLST {
+		return ftpEntry{}, ErrUnsupported
+	}
+	e, err := fs.getEntry(name)
+	if err == ErrUnsupported {
+		fs.noMLST = true
+	}
+	return e, err
+}
+
+// canMLST reports whether MLST can be sent, without sending it.
+func (fs *FS) canMLST() bool {
+	if fs.noMLST {
+		return false
+	}
+	if _, ok := fs.conn.(entryGetter); ok {
+		return true
+	}
+	ok, err := fs.hasFeature("MLST")
+	return err == nil && ok
+}
+
+func (fs *FS) getEntry(name string) (ftpEntry, error) {
+	if g, ok := fs.conn.(entryGetter); ok {
+		fs.idle()
+		fs.debugf("> MLST %s", name)
+		name, err := fs.encode(name)
+		if err != nil {
+			return ftpEntry{}, err
+		}
+		e, err := g.GetEntry(name)
+		fs.debugReply(err)
+		if err != nil && notImplemented(replyCode(err)) {
+			err = ErrUnsupported
+		}
+		if err != nil {
+			return ftpEntry{}, err
+		}
+		e.Name = fs.decode(e.Name)
+		return ftpEntry{Entry: e, typed: e.Type != ftp.EntryTypeLink}, nil
+	}
+
+	ok, err := fs.hasFeature("MLST")
+	if err != nil {
+		return ftpEntry{}, err
+	}
+	if !ok {
+		return ftpEntry{}, ErrUnsupported
+	}
+	_, msg, err := fs.cmd(250, "MLST %s", name)
+	if err != nil {
+		return ftpEntry{}, err
+	}
+	for _, line := range strings.Split(msg, "\n") {
+		// the fact line is indented by a space
+		if strings.HasPrefix(line, " ") {
+			return parseMLST(line[1:])
+		}
+	}
+	return ftpEntry{}, errListLine
+}
+
+// parseMLST parses a fact line of MLST or MLSD, like
+//
+//	type=file;size=1234;modify=20060102150405;unique=802U1234; name
+func parseMLST(line string) (ftpEntry, error) {
+	i := strings.Index(line, "; ")
+	if i < 0 {
+		return ftpEntry{}, errListLine
+	}
+	e := &ftp.Entry{Name: path.Base(line[i+2:])}
+	var unique string
+	typed := false
+	for _, fact := range strings.Split(line[:i], ";") {
+		kv := strings.SplitN(fact, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v := kv[1]
+		switch strings.ToLower(kv[0]) {
+		case "type":
+			switch t := strings.ToLower(v); {
+			case t == "file":
+				e.Type = ftp.EntryTypeFile
+				typed = true
+			case t == "dir" || t == "cdir" || t == "pdir":
+				e.Type = ftp.EntryTypeFolder
+				typed = true
+			case strings.Contains(t, "slink"):
+				// OS.unix=slink, or OS.unix=slink:/target
+				e.Type = ftp.EntryTypeLink
+			}
+		case "size":
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return ftpEntry{}, errListLine
+			}
+			e.Size = n
+		case "modify":
+			if j := strings.IndexByte(v, '.'); j >= 0 {
+				// drop fractions of second
+				v = v[:j]
+			}
+			t, err := time.Parse("20060102150405", v)
+			if err != nil {
+				return ftpEntry{}, errListLine
+			}
+			e.Time = t
+		case "unique":
+			unique = v
+		}
+	}
+	return ftpEntry{Entry: e, unique: unique, typed: typed}, nil
+}
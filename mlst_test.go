@@ -0,0 +1,150 @@
+package ftpfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/goftp/ftp"
+)
+
+// mlstConn returns a cmdConn serving files, which advertises MLST and
+// answers it for the paths of facts with their facts.
+func mlstConn(files map[string]string, facts map[string]string) cmdConn {
+	c := cmdConn{newFakeConn(files), map[string]string{
+		"FEAT": "211 Features:\n MLST type*;size*;modify*;unique*;\nEnd",
+	}}
+	for name, f := range facts {
+		c.replies["MLST "+name] = "250 Listing " + name + "\n " + f + "; " + name + "\nEnd"
+	}
+	return c
+}
+
+func TestOpenMLST(t *testing.T) {
+	// the directory /x holds a single file x, which LIST can not tell
+	// from the file /x
+	files := map[string]string{"/x/x": "hello"}
+	c := mlstConn(files, map[string]string{
+		"/x":   "type=dir;modify=20200102030405",
+		"/x/x": "type=file;size=5;modify=20200102030405",
+	})
+	fs := NewConn(c)
+	_, isDir, err := fs.OpenType("/x")
+	if err != nil || !isDir {
+		t.Fatalf("OpenType(/x) = %t, %v; want a directory", isDir, err)
+	}
+	f, isDir, err := fs.OpenType("/x/x")
+	if err != nil || isDir {
+		t.Fatalf("OpenType(/x/x) = %t, %v; want a file", isDir, err)
+	}
+	if fi, _ := f.Stat(); fi.Size() != 5 {
+		t.Fatalf("size of /x/x %d, want 5", fi.Size())
+	}
+	if n := c.count("LIST"); n != 1 {
+		t.Fatalf("sent %q, want only the LIST of the directory", c.sent)
+	}
+
+	// without MLST, the listing is all there is
+	c = cmdConn{newFakeConn(files), map[string]string{"FEAT": "211 Features:\n MDTM\nEnd"}}
+	if _, isDir, err := NewConn(c).OpenType("/x"); err != nil || isDir {
+		t.Fatalf("OpenType(/x) without MLST = %t, %v; want the file heuristic", isDir, err)
+	}
+	if n := c.count("MLST"); n != 0 {
+		t.Fatalf("sent %q, MLST is not advertised", c.sent)
+	}
+}
+
+func TestOpenMLSTLink(t *testing.T) {
+	// MLST tells /l is a link, but not what it leads to
+	c := mlstConn(map[string]string{"/d/a.txt": "hello"}, map[string]string{
+		"/l": "type=OS.unix=slink:/d;modify=20200102030405",
+	})
+	c.dirs["/l"] = c.dirs["/d"]
+	if e, err := parseMLST("type=OS.unix=slink:/d; l"); err != nil || e.Type != ftp.EntryTypeLink {
+		t.Fatalf("parseMLST of a link = %v, %v; want a link", e.Entry, err)
+	}
+	fs := NewConn(c)
+	if _, isDir, err := fs.OpenType("/l"); err != nil || !isDir {
+		t.Fatalf("OpenType(/l) = %t, %v; want the directory it leads to", isDir, err)
+	}
+	if fi, err := fs.Stat("/l"); err != nil || !fi.IsDir() {
+		t.Fatalf("Stat(/l) = %v, %v; want a directory", fi, err)
+	}
+	if n := c.count("LIST /l"); n == 0 {
+		t.Fatalf("sent %q, want a LIST of the link", c.sent)
+	}
+}
+
+func TestStatMLST(t *testing.T) {
+	files := map[string]string{"/d/a.txt": "hello"}
+	c := mlstConn(files, map[string]string{
+		"/d":       "type=dir;modify=20200102030405",
+		"/d/a.txt": "type=file;size=5;modify=20210304050607",
+	})
+	c.replies["MLST /missing"] = "550 No such file"
+	fs := NewConn(c)
+	fi, err := fs.Stat("/d/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	if fi.Name() != "a.txt" || fi.IsDir() || fi.Size() != 5 || !fi.ModTime().Equal(mtime) {
+		t.Fatalf("Stat(/d/a.txt) = %s %t %d %v, want the MLST facts", fi.Name(), fi.IsDir(), fi.Size(), fi.ModTime())
+	}
+	if fi, err := fs.Stat("/d"); err != nil || !fi.IsDir() {
+		t.Fatalf("Stat(/d) = %v, %v; want a directory", fi, err)
+	}
+	if _, err := fs.Stat("/missing"); err != ErrNotFound {
+		t.Fatalf("Stat of a missing name: %v, want ErrNotFound", err)
+	}
+	if n := c.count("LIST"); n != 0 {
+		t.Fatalf("sent %q, want MLST only", c.sent)
+	}
+
+	// without MLST, Stat lists
+	c = cmdConn{newFakeConn(files), nil}
+	fi, err = NewConn(c).Stat("/d/a.txt")
+	if err != nil || fi.Size() != 5 || !fi.ModTime().Equal(fakeTime) {
+		t.Fatalf("Stat(/d/a.txt) without MLST = %v, %v", fi, err)
+	}
+	if c.count("LIST") == 0 || c.count("MLST") != 0 {
+		t.Fatalf("sent %q, want LIST instead of MLST", c.sent)
+	}
+}
+
+func TestUnique(t *testing.T) {
+	files := map[string]string{"/d/a.txt": "a", "/d/b.txt": "b"}
+	c := mlstConn(files, map[string]string{
+		"/d/a.txt": "type=file;size=1;modify=20200102030405;unique=802U1234",
+		"/d/b.txt": "type=file;size=1;modify=20200102030405",
+	})
+	fs := NewConn(c)
+	unique := func(name string) string {
+		t.Helper()
+		fi, err := fs.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, ok := fi.(interface{ Unique() string })
+		if !ok {
+			t.Fatalf("FileInfo of %s has no Unique method", name)
+		}
+		return u.Unique()
+	}
+	if u := unique("/d/a.txt"); u != "802U1234" {
+		t.Fatalf("Unique() of /d/a.txt = %q, want 802U1234", u)
+	}
+	if u := unique("/d/b.txt"); u != "" {
+		t.Fatalf("Unique() without the fact = %q, want none", u)
+	}
+
+	// the file keeps the facts it was opened with
+	f, err := fs.Open("/d/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, _ := f.Stat()
+	if u, ok := fi.(interface{ Unique() string }); !ok || u.Unique() != "802U1234" {
+		t.Fatalf("Stat of the opened file = %v, want the unique fact", fi)
+	}
+}
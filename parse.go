@@ -0,0 +1,150 @@
+package ftpfs
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goftp/ftp"
+)
+
+// ErrUseDefault may be returned by FS.ParseEntry to parse a line with the
+// default parser.
+var ErrUseDefault = errors.New("use default parser")
+
+var errListLine = errors.New("unsupported LIST line")
+
+// lineLister is implemented by FTP clients which can return the raw lines
+// of a LIST reply.
+type lineLister interface {
+	ListLines(path string) ([]string, error)
+}
+
+// listParsed lists name on c with the raw lines parsed by fs.ParseEntry.
+// Lines which parse to a nil entry are skipped.
+func (fs *FS) listParsed(c Conn, name string) ([]*ftp.Entry, error) {
+	ll, ok := c.(lineLister)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	lines, err := ll.ListLines(name)
+	if err != nil {
+		return nil, err
+	}
+	var ls []*ftp.Entry
+	for _, line := range lines {
+		e, err := fs.ParseEntry(line)
+		if err == ErrUseDefault {
+			e, err = parseListLine(line)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if e != nil {
+			ls = append(ls, e)
+		}
+	}
+	return ls, nil
+}
+
+// parseListLine parses a line of LIST output in the Unix ls or the DOS
+// format. It returns a nil entry for the "total" line of ls.
+func parseListLine(line string) (*ftp.Entry, error) {
+	if strings.HasPrefix(line, "total ") {
+		return nil, nil
+	}
+	if e, err := parseUnixLine(line); err == nil {
+		return e, nil
+	}
+	return parseDOSLine(line)
+}
+
+// parseUnixLine parses
+//
+//	-rw-r--r--   1 owner group  1234 Jan 02 15:04 name
+//	drwxr-xr-x   2 owner group  4096 Jan 02  2006 name
+func parseUnixLine(line string) (*ftp.Entry, error) {
+	f := strings.Fields(line)
+	if len(f) < 9 || len(f[0]) != 10 {
+		return nil, errListLine
+	}
+	e := &ftp.Entry{}
+	switch f[0][0] {
+	case '-':
+		e.Type = ftp.EntryTypeFile
+	case 'd':
+		e.Type = ftp.EntryTypeFolder
+	case 'l':
+		e.Type = ftp.EntryTypeLink
+	default:
+		return nil, errListLine
+	}
+	size, err := strconv.ParseUint(f[4], 10, 64)
+	if err != nil {
+		return nil, errListLine
+	}
+	e.Size = size
+
+	stamp := strings.Join(f[5:8], " ")
+	if strings.Contains(f[7], ":") {
+		e.Time, err = time.Parse("Jan 2 15:04", stamp)
+		if err == nil {
+			now := time.Now()
+			e.Time = e.Time.AddDate(now.Year(), 0, 0)
+			if e.Time.After(now) {
+				// ls shows the time only for files of the past
+				// months, it may be last year
+				e.Time = e.Time.AddDate(-1, 0, 0)
+			}
+		}
+	} else {
+		e.Time, err = time.Parse("Jan 2 2006", stamp)
+	}
+	if err != nil {
+		return nil, errListLine
+	}
+
+	// the name may contain spaces
+	e.Name = fieldsFrom(line, 8)
+	return e, nil
+}
+
+// parseDOSLine parses
+//
+//	01-02-06  03:04PM       <DIR>          name
+//	01-02-06  03:04PM                 1234 name
+func parseDOSLine(line string) (*ftp.Entry, error) {
+	f := strings.Fields(line)
+	if len(f) < 4 {
+		return nil, errListLine
+	}
+	t, err := time.Parse("01-02-06 03:04PM", f[0]+" "+f[1])
+	if err != nil {
+		return nil, errListLine
+	}
+	e := &ftp.Entry{Time: t, Name: fieldsFrom(line, 3)}
+	if f[2] == "<DIR>" {
+		e.Type = ftp.EntryTypeFolder
+	} else {
+		e.Type = ftp.EntryTypeFile
+		if e.Size, err = strconv.ParseUint(f[2], 10, 64); err != nil {
+			return nil, errListLine
+		}
+	}
+	return e, nil
+}
+
+// fieldsFrom returns line from the start of its n-th space separated
+// field to the end.
+func fieldsFrom(line string, n int) string {
+	for i := 0; i < n; i++ {
+		line = strings.TrimLeft(line, " ")
+		j := strings.IndexByte(line, ' ')
+		if j < 0 {
+			return ""
+		}
+		line = line[j:]
+	}
+	return strings.TrimLeft(line, " ")
+}
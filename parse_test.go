@@ -0,0 +1,74 @@
+package ftpfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/goftp/ftp"
+)
+
+// linesConn is a fakeConn which returns the raw lines of LIST, see
+// lineLister, from lines by directory.
+type linesConn struct {
+	*fakeConn
+	lines map[string][]string
+}
+
+func (c linesConn) ListLines(name string) ([]string, error) {
+	c.sent = append(c.sent, "LIST "+name)
+	return c.lines[name], nil
+}
+
+func TestParseEntry(t *testing.T) {
+	c := linesConn{newFakeConn(nil), map[string][]string{"/d": {
+		"F|a.txt|5",
+		"D|sub|0",
+		"-rw-r--r--   1 owner group     3 Jan 02 15:04 b.txt",
+		"# comment",
+	}}}
+	c.mkdir("/d")
+	fs := NewConn(c)
+	fs.ParseEntry = func(line string) (*ftp.Entry, error) {
+		if strings.HasPrefix(line, "#") {
+			return nil, nil
+		}
+		f := strings.Split(line, "|")
+		if len(f) != 3 {
+			return nil, ErrUseDefault
+		}
+		n, err := strconv.ParseUint(f[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		e := &ftp.Entry{Name: f[1], Size: n, Type: ftp.EntryTypeFile}
+		if f[0] == "D" {
+			e.Type = ftp.EntryTypeFolder
+		}
+		return e, nil
+	}
+
+	d, err := fs.Open("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := d.Readdir(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range fi {
+		got = append(got, fmt.Sprintf("%s %d %t", e.Name(), e.Size(), e.IsDir()))
+	}
+	want := "a.txt 5 false, b.txt 3 false, sub 0 true"
+	if strings.Join(got, ", ") != want {
+		t.Fatalf("Readdir = %q, want %q", got, want)
+	}
+
+	plain := NewConn(c.fakeConn)
+	plain.ParseEntry = fs.ParseEntry
+	if _, err := plain.Open("/d"); err != ErrUnsupported {
+		t.Errorf("Open with ParseEntry, without ListLines: %v, want ErrUnsupported", err)
+	}
+}
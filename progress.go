@@ -0,0 +1,22 @@
+package ftpfs
+
+import (
+	"io"
+	"time"
+)
+
+// progress reports the position of f to fs.Progress after a Read which
+// returned err, at most every fs.ProgressInterval, and at the end of the
+// file.
+func (f *File) progress(err error) {
+	p := f.fs.Progress
+	if p == nil {
+		return
+	}
+	now := time.Now()
+	if err != io.EOF && now.Sub(f.reported) < f.fs.ProgressInterval {
+		return
+	}
+	f.reported = now
+	p(f.path, int64(f.next), f.size)
+}
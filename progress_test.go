@@ -0,0 +1,44 @@
+package ftpfs
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestProgressInterval(t *testing.T) {
+	for _, tt := range []struct {
+		interval time.Duration
+		calls    int
+	}{
+		{0, 101},
+		{time.Hour, 2},
+	} {
+		fs := NewConn(newFakeConn(map[string]string{"/f": testData(1000)}))
+		var got []string
+		fs.Progress = func(name string, pos, size int64) {
+			got = append(got, fmt.Sprintf("%s %d/%d", name, pos, size))
+		}
+		fs.ProgressInterval = tt.interval
+		f, err := fs.Open("/f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 10)
+		for err == nil {
+			_, err = f.Read(b)
+		}
+		f.Close()
+		if err != io.EOF {
+			t.Fatal(err)
+		}
+		if len(got) != tt.calls {
+			t.Errorf("ProgressInterval %v: %d calls, want %d", tt.interval, len(got), tt.calls)
+			continue
+		}
+		if got[0] != "/f 10/1000" || got[len(got)-1] != "/f 1000/1000" {
+			t.Errorf("ProgressInterval %v: first call %q, last %q; want 10 to 1000", tt.interval, got[0], got[len(got)-1])
+		}
+	}
+}
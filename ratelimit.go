@@ -0,0 +1,68 @@
+package ftpfs
+
+import (
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket limiting a rate of bytes per second, with a
+// burst of one second.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate int64) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &bucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// take takes n tokens and returns how long to wait until they are
+// available. A nil bucket does not limit.
+func (b *bucket) take(n int) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// limit returns b short enough to be read within a second at the rate
+// limits of f.
+func (f *File) limit(b []byte) []byte {
+	for _, r := range []int64{f.fs.RateLimit, f.fs.TotalRateLimit} {
+		if r > 0 && int64(len(b)) > r {
+			b = b[:r]
+		}
+	}
+	return b
+}
+
+// throttle waits after n bytes were read, as required by the rate limits
+// of f. It must be called without f.fs.mu held, so other files are not
+// held up.
+func (f *File) throttle(n int) {
+	d := f.rate.take(n)
+	if g := f.total.take(n); g > d {
+		d = g
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
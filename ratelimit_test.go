@@ -0,0 +1,54 @@
+package ftpfs
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	data := testData(150000)
+	fs := NewConn(newFakeConn(map[string]string{"/a": data}))
+	fs.RateLimit = 100000
+	f, err := fs.Open("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	b, err := io.ReadAll(f)
+	if err != nil || string(b) != data {
+		t.Fatalf("read %d bytes, %v", len(b), err)
+	}
+	// a second of burst, then half a second at the rate
+	if d := time.Since(start); d < 400*time.Millisecond || d > 2*time.Second {
+		t.Fatalf("read %d bytes at %d B/s in %v, want about 500ms", len(data), fs.RateLimit, d)
+	}
+}
+
+func TestTotalRateLimit(t *testing.T) {
+	data := testData(75000)
+	fs := NewMemFS(map[string][]byte{"a": []byte(data), "b": []byte(data)})
+	fs.TotalRateLimit = 100000
+	start := time.Now()
+	// a file is opened as the other is read, which -race checks too
+	var wg sync.WaitGroup
+	for _, name := range []string{"/a", "/b"} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			f, err := fs.Open(name)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if b, err := io.ReadAll(f); err != nil || string(b) != data {
+				t.Errorf("read %d bytes of %s, %v", len(b), name, err)
+			}
+		}(name)
+	}
+	wg.Wait()
+	if d := time.Since(start); d < 400*time.Millisecond || d > 2*time.Second {
+		t.Fatalf("read 2x%d bytes at %d B/s in %v, want about 500ms", len(data), fs.TotalRateLimit, d)
+	}
+}
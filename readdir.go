@@ -0,0 +1,389 @@
+package ftpfs
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/goftp/ftp"
+)
+
+// readDir opens the directory name with fs.mu held. It returns
+// ErrReadFile if name is a file.
+func (fs *FS) readDir(name string) (*ftpDir, error) {
+	f, err := fs.open(name)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := f.(*ftpDir)
+	if !ok {
+		// f has no data connection yet, nothing to close
+		return nil, ErrReadFile
+	}
+	return d, nil
+}
+
+// ReadDirFiltered lists the directory name, sorted by name, with only
+// the entries of type want, e.g. ftp.EntryTypeFolder for subdirectories.
+func (fs *FS) ReadDirFiltered(name string, want ftp.EntryType) ([]os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	d, err := fs.readDir(name)
+	if err != nil {
+		return nil, err
+	}
+	var b []os.FileInfo
+	for _, fi := range d.fi {
+		if e, ok := fi.(ftpEntry); ok && e.Type == want {
+			b = append(b, fi)
+		}
+	}
+	return b, nil
+}
+
+// ReadDirMap lists the directory name, with the entries keyed by name.
+// If the server lists a name twice, the first entry is kept.
+func (fs *FS) ReadDirMap(name string) (map[string]os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	d, err := fs.readDir(name)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]os.FileInfo, len(d.fi))
+	for _, fi := range d.fi {
+		if _, ok := m[fi.Name()]; !ok {
+			m[fi.Name()] = fi
+		}
+	}
+	return m, nil
+}
+
+// ListMatch lists the entries of the directory dir whose name matches
+// pattern, as in path.Match, sorted by name.
+//
+// When the Conn has NameList and the server supports MLST, the server
+// filters the names with NLST dir/pattern, and the entries are asked
+// with MLST, so the whole directory is not transferred. Which names it
+// gives depends on the glob of the server: e.g. servers using ls leave
+// out names starting with a dot, unless the pattern does. Names outside
+// of dir, as the content of matching directories, are dropped.
+//
+// Otherwise, or if the server refuses the pattern, the whole directory is
+// listed and filtered here: the pattern is not sent with LIST, as the ls
+// of many servers would also list the content of matching directories,
+// which could not be told from entries of dir.
+func (fs *FS) ListMatch(dir, pattern string) ([]os.FileInfo, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if b, ok, err := fs.matchOnServer(dir, pattern); ok || err != nil {
+		return b, err
+	}
+	d, err := fs.readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var b []os.FileInfo
+	for _, fi := range d.fi {
+		if ok, _ := path.Match(pattern, fi.Name()); ok {
+			b = append(b, fi)
+		}
+	}
+	return b, nil
+}
+
+// matchOnServer lists the entries of dir matching pattern with NLST and
+// MLST, for ListMatch. It reports false if the server can not.
+func (fs *FS) matchOnServer(dir, pattern string) ([]os.FileInfo, bool, error) {
+	nl, ok := fs.conn.(nameLister)
+	if !ok || strings.Contains(pattern, "/") || !fs.canMLST() {
+		return nil, false, nil
+	}
+	dir, err := fs.abs(dir)
+	if err != nil {
+		return nil, false, err
+	}
+	ls, err := fs.nameList(nl, path.Join(dir, pattern))
+	if replyCode(err) != 0 {
+		// no match, or the pattern is not supported: list dir instead
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	seen := make(map[string]bool)
+	var b []os.FileInfo
+	for _, n := range ls {
+		n = strings.TrimSuffix(n, "/")
+		if strings.Contains(n, "/") && path.Dir(n) != dir {
+			// in a matching directory, or not in dir at all
+			continue
+		}
+		n = path.Base(n)
+		if ok, _ := path.Match(pattern, n); !ok || n == "." || n == ".." || seen[n] {
+			continue
+		}
+		seen[n] = true
+		e, err := fs.mlst(path.Join(dir, n))
+		switch {
+		case replyCode(err) == 550:
+			// a bare name of the content of a matching directory
+			continue
+		case err == ErrUnsupported:
+			return nil, false, nil
+		case err != nil:
+			return nil, false, err
+		}
+		b = append(b, e)
+	}
+	sort.Slice(b, func(i, j int) bool { return b[i].Name() < b[j].Name() })
+	return b, true, nil
+}
+
+// OpenLatest opens the newest file of the directory dir whose name
+// matches pattern, as with ListMatch, e.g. to serve the latest build. Of
+// files with the same time, the last by name is opened. It returns
+// ErrNotFound if no file matches.
+func (fs *FS) OpenLatest(dir, pattern string) (http.File, os.FileInfo, error) {
+	ls, err := fs.ListMatch(dir, pattern)
+	if err != nil {
+		return nil, nil, err
+	}
+	var latest os.FileInfo
+	for _, fi := range ls {
+		if !fi.IsDir() && (latest == nil || !fi.ModTime().Before(latest.ModTime())) {
+			latest = fi
+		}
+	}
+	if latest == nil {
+		return nil, nil, ErrNotFound
+	}
+	f, err := fs.Open(path.Join(dir, latest.Name()))
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, latest, nil
+}
+
+// ListNames returns the names in the directory dir, sorted, without "."
+// and "..". It issues NLST, whose reply is simpler to read than the one
+// of LIST, if the FTP client supports it; names the server sends with
+// their directory are trimmed to their base.
+func (fs *FS) ListNames(dir string) ([]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	nl, ok := fs.conn.(nameLister)
+	if !ok {
+		d, err := fs.readDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		names := make([]string, len(d.fi))
+		for i, fi := range d.fi {
+			names[i] = fi.Name()
+		}
+		return names, nil
+	}
+
+	dir, err := fs.abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	ls, err := fs.nameList(nl, dir)
+	if c := replyCode(err); c == 450 || c == 550 {
+		// servers may refuse to NLST an empty directory
+		if err := fs.probeDir(dir); err != nil {
+			return nil, err
+		}
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := ls[:0]
+	for _, n := range ls {
+		n = path.Base(n)
+		if n != "." && n != ".." && n != "/" {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// CountEntries returns the number of entries in the directory name,
+// without "." and "..". It looks name up as Open does, so it returns
+// ErrReadFile for a file, and counts at most FS.MaxDirEntries entries.
+func (fs *FS) CountEntries(name string) (int, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// count the listing, without sorting the entries of a directory
+	f, l, err := fs.find(name)
+	if err != nil {
+		return 0, err
+	}
+	if f != nil {
+		return 0, ErrReadFile
+	}
+	n := len(trimDots(l.entries))
+	if fs.MaxDirEntries > 0 && n > fs.MaxDirEntries {
+		n = fs.MaxDirEntries
+	}
+	return n, nil
+}
+
+// ReadDirPage returns up to limit entries of the directory name, sorted by
+// name, following the entry named after; after is "" for the first page.
+// The returned cursor is the after of the next page, or "" if there is
+// none. As FTP cannot page, each page lists the whole directory.
+func (fs *FS) ReadDirPage(name, after string, limit int) ([]os.FileInfo, string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	d, err := fs.readDir(name)
+	if err != nil {
+		return nil, "", err
+	}
+	fi := d.fi
+	if after != "" {
+		i := sort.Search(len(fi), func(i int) bool { return fi[i].Name() > after })
+		fi = fi[i:]
+	}
+	if limit <= 0 || limit >= len(fi) {
+		return fi, "", nil
+	}
+	fi = fi[:limit]
+	return fi, fi[limit-1].Name(), nil
+}
+
+// ReadDirSince lists the directory name, sorted by name, with only the
+// entries modified after since. As LIST times may only be precise to the
+// minute or the day, the time of files within a day of since is asked
+// with MDTM when the server supports it and the Conn can send it with
+// Cmd, which *ftp.ServerConn can not.
+func (fs *FS) ReadDirSince(name string, since time.Time) ([]os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	d, err := fs.readDir(name)
+	if err != nil {
+		return nil, err
+	}
+	mdtm := true
+	var b []os.FileInfo
+	for _, fi := range d.fi {
+		if e, ok := fi.(ftpEntry); ok && mdtm && !e.IsDir() && nearTime(e.Time, since) {
+			switch t, err := fs.modTime(path.Join(d.path, e.Name())); {
+			case err == nil:
+				e.Time = t
+			case err == ErrUnsupported:
+				mdtm = false
+			case replyCode(err) >= 500:
+				// keep the LIST time
+			default:
+				return nil, err
+			}
+		}
+		if fi.ModTime().After(since) {
+			b = append(b, fi)
+		}
+	}
+	return b, nil
+}
+
+// nearTime reports whether t is within a day of u.
+func nearTime(t, u time.Time) bool {
+	d := t.Sub(u)
+	return d < 24*time.Hour && d > -24*time.Hour
+}
+
+// Readlink returns the target of the symbolic link name, without
+// following it. The target is read from the "name -> target" LIST line
+// of the parent directory, as listing the link itself may follow it. It
+// returns ErrInvalid if name is not a symbolic link, or if the server
+// does not show the target.
+func (fs *FS) Readlink(name string) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name, err := fs.abs(name)
+	if err != nil {
+		return "", err
+	}
+	return fs.readlink(name)
+}
+
+// EvalSymlinks returns name with its last element resolved while it is a
+// symbolic link, see Readlink. Links in the parent directories are left
+// to the server. A chain longer than fs.MaxSymlinkDepth, or looping,
+// returns ErrTooManyLinks.
+func (fs *FS) EvalSymlinks(name string) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name, err := fs.abs(name)
+	if err != nil {
+		return "", err
+	}
+	max := fs.MaxSymlinkDepth
+	if max <= 0 {
+		max = 40
+	}
+	seen := make(map[string]bool)
+	for {
+		target, err := fs.readlink(name)
+		if err == ErrInvalid {
+			return fs.unroot(name), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if len(seen) >= max {
+			// name is one link more than allowed
+			return "", ErrTooManyLinks
+		}
+		seen[name] = true
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(name), target)
+		}
+		name = path.Clean(target)
+		if seen[name] {
+			return "", ErrTooManyLinks
+		}
+	}
+}
+
+// readlink implements Readlink for the absolute name with fs.mu held.
+func (fs *FS) readlink(name string) (string, error) {
+	ls, err := fs.list(path.Dir(name))
+	if err != nil {
+		return "", err
+	}
+	base := path.Base(name)
+	for _, e := range ls {
+		link, target, ok := strings.Cut(e.Name, " -> ")
+		if !ok {
+			link = e.Name
+		}
+		if link != base {
+			continue
+		}
+		if e.Type != ftp.EntryTypeLink || !ok {
+			return "", ErrInvalid
+		}
+		return target, nil
+	}
+	return "", ErrNotFound
+}
@@ -0,0 +1,392 @@
+package ftpfs
+
+import (
+	"io"
+	"net/textproto"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goftp/ftp"
+)
+
+// names returns the names of fi, separated by spaces.
+func names(fi []os.FileInfo) string {
+	b := make([]string, len(fi))
+	for i, e := range fi {
+		b[i] = e.Name()
+	}
+	return strings.Join(b, " ")
+}
+
+func TestReadDirFiltered(t *testing.T) {
+	fs := NewConn(newFakeConn(map[string]string{
+		"/d/b.txt": "b",
+		"/d/a.txt": "a",
+		"/d/x/":    "",
+		"/d/c/":    "",
+	}))
+	for _, tt := range []struct {
+		typ  ftp.EntryType
+		want string
+	}{
+		{ftp.EntryTypeFile, "a.txt b.txt"},
+		{ftp.EntryTypeFolder, "c x"},
+	} {
+		fi, err := fs.ReadDirFiltered("/d", tt.typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := names(fi); got != tt.want {
+			t.Errorf("ReadDirFiltered(%v) = %q, want %q", tt.typ, got, tt.want)
+		}
+	}
+}
+
+func TestCountEntries(t *testing.T) {
+	c := newFakeConn(map[string]string{"/d/a": "a", "/d/b": "b", "/d/e/": ""})
+	c.dirs["/d"] = append(c.dirs["/d"],
+		&ftp.Entry{Name: ".", Type: ftp.EntryTypeFolder},
+		&ftp.Entry{Name: "..", Type: ftp.EntryTypeFolder})
+	fs := NewConn(c)
+	if n, err := fs.CountEntries("/d"); n != 3 || err != nil {
+		t.Errorf("CountEntries = %d, %v; want 3", n, err)
+	}
+	if _, err := fs.CountEntries("/d/a"); err != ErrReadFile {
+		t.Errorf("CountEntries of a file: %v, want ErrReadFile", err)
+	}
+	fs.MaxDirEntries = 2
+	if n, err := fs.CountEntries("/d"); n != 2 || err != nil {
+		t.Errorf("CountEntries with MaxDirEntries 2 = %d, %v; want 2", n, err)
+	}
+}
+
+func TestReadDirPage(t *testing.T) {
+	fs := NewConn(newFakeConn(map[string]string{
+		"/d/e": "", "/d/c": "", "/d/a": "", "/d/d": "", "/d/b": "",
+	}))
+	var pages []string
+	after := ""
+	for i := 0; i < 5; i++ {
+		fi, next, err := fs.ReadDirPage("/d", after, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, names(fi))
+		if next == "" {
+			break
+		}
+		after = next
+	}
+	if got, want := strings.Join(pages, ","), "a b,c d,e"; got != want {
+		t.Fatalf("pages %q, want %q", got, want)
+	}
+}
+
+func TestReadDirSince(t *testing.T) {
+	since := fakeTime.Add(30 * time.Second)
+	c := cmdConn{newFakeConn(map[string]string{
+		"/d/old.txt":    "o",
+		"/d/new.txt":    "n",
+		"/d/before.txt": "b",
+		"/d/after.txt":  "a",
+		"/d/sub/":       "",
+	}), map[string]string{
+		// LIST shows the minute of both
+		"MDTM /d/before.txt": "213 20200102030415",
+		"MDTM /d/after.txt":  "213 20200102030450.123",
+	}}
+	c.entry("/d/old.txt").Time = fakeTime.AddDate(0, 0, -10)
+	c.entry("/d/new.txt").Time = fakeTime.AddDate(0, 0, 10)
+	c.entry("/d/sub").Time = fakeTime.AddDate(0, 0, 10)
+	fs := NewConn(c)
+	fi, err := fs.ReadDirSince("/d", since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(fi); got != "after.txt new.txt sub" {
+		t.Fatalf("ReadDirSince = %s, want after.txt new.txt sub", got)
+	}
+	if n := c.count("MDTM"); n != 2 {
+		t.Fatalf("sent %q, want MDTM of the files near the cutoff only", c.sent)
+	}
+
+	// without MDTM, the LIST times are kept
+	fs = NewConn(newFakeConn(map[string]string{"/d/before.txt": "b"}))
+	if fi, err := fs.ReadDirSince("/d", fakeTime.Add(-time.Second)); err != nil || names(fi) != "before.txt" {
+		t.Fatalf("ReadDirSince without MDTM = %v, %v", fi, err)
+	}
+}
+
+func TestReadlink(t *testing.T) {
+	c := newFakeConn(map[string]string{"/d/a.txt": "a", "/d/releases/v2/": ""})
+	c.dirs["/d"] = append(c.dirs["/d"],
+		&ftp.Entry{Name: "current -> releases/v2", Type: ftp.EntryTypeLink, Time: fakeTime},
+		&ftp.Entry{Name: "bare", Type: ftp.EntryTypeLink, Time: fakeTime})
+	fs := NewConn(c)
+	target, err := fs.Readlink("/d/current")
+	if err != nil || target != "releases/v2" {
+		t.Fatalf("Readlink(/d/current) = %q, %v; want releases/v2", target, err)
+	}
+	if c.sent[len(c.sent)-1] != "LIST /d" {
+		t.Fatalf("sent %q, want the LIST of the parent", c.sent)
+	}
+	for name, want := range map[string]error{
+		"/d/a.txt":    ErrInvalid,
+		"/d/bare":     ErrInvalid,
+		"/d/missing":  ErrNotFound,
+		"/d/releases": ErrInvalid,
+	} {
+		if _, err := fs.Readlink(name); err != want {
+			t.Errorf("Readlink(%s): %v, want %v", name, err, want)
+		}
+	}
+}
+
+func TestReadDirMap(t *testing.T) {
+	c := newFakeConn(map[string]string{"/d/a.txt": "a", "/d/sub/": ""})
+	// an odd server listing a name twice, and the dot entries
+	c.dirs["/d"] = append(c.dirs["/d"],
+		&ftp.Entry{Name: "a.txt", Type: ftp.EntryTypeFile, Size: 99, Time: fakeTime},
+		&ftp.Entry{Name: ".", Type: ftp.EntryTypeFolder, Time: fakeTime},
+		&ftp.Entry{Name: "..", Type: ftp.EntryTypeFolder, Time: fakeTime})
+	fs := NewConn(c)
+	for i := 0; i < 3; i++ {
+		m, err := fs.ReadDirMap("/d")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m) != 2 || m["sub"] == nil || !m["sub"].IsDir() {
+			t.Fatalf("ReadDirMap = %v, want a.txt and sub", m)
+		}
+		if fi := m["a.txt"]; fi == nil || fi.Size() != 1 {
+			t.Fatalf("a.txt is %v, want the first entry listed", fi)
+		}
+	}
+	if _, err := fs.ReadDirMap("/missing"); err != ErrNotFound {
+		t.Fatalf("ReadDirMap of a missing directory: %v, want ErrNotFound", err)
+	}
+}
+
+func TestEvalSymlinks(t *testing.T) {
+	c := newFakeConn(map[string]string{"/d/a.txt": "a"})
+	for link, target := range map[string]string{
+		"loop": "loop",
+		"l1":   "l2",
+		"l2":   "/d/l3",
+		"l3":   "a.txt",
+		"ping": "pong",
+		"pong": "ping",
+	} {
+		c.dirs["/d"] = append(c.dirs["/d"], &ftp.Entry{Name: link + " -> " + target, Type: ftp.EntryTypeLink, Time: fakeTime})
+	}
+	fs := NewConn(c)
+	if got, err := fs.EvalSymlinks("/d/l1"); err != nil || got != "/d/a.txt" {
+		t.Fatalf("EvalSymlinks(/d/l1) = %q, %v; want /d/a.txt", got, err)
+	}
+	for _, name := range []string{"/d/loop", "/d/ping"} {
+		if _, err := fs.EvalSymlinks(name); err != ErrTooManyLinks {
+			t.Errorf("EvalSymlinks(%s): %v, want ErrTooManyLinks", name, err)
+		}
+	}
+	fs.MaxSymlinkDepth = 2
+	if _, err := fs.EvalSymlinks("/d/l1"); err != ErrTooManyLinks {
+		t.Fatalf("EvalSymlinks(/d/l1) of 3 links with MaxSymlinkDepth 2: %v, want ErrTooManyLinks", err)
+	}
+}
+
+func TestListMatch(t *testing.T) {
+	c := newFakeConn(map[string]string{
+		"/d/a.log":       "a",
+		"/d/b.txt":       "b",
+		"/d/c.log":       "c",
+		"/d/old.log/x":   "x",
+		"/d/sub/d.log":   "d",
+		"/d/sub/e.txt":   "e",
+		"/d/.hidden.log": "h",
+	})
+	fs := NewConn(c)
+	fi, err := fs.ListMatch("/d", "*.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the content of old.log is not mistaken for entries of /d
+	if got := names(fi); got != ".hidden.log a.log c.log old.log" {
+		t.Fatalf("ListMatch(/d, *.log) = %s", got)
+	}
+	if strings.Join(c.sent, " ") != "LIST /d" {
+		t.Fatalf("sent %q, want LIST /d without the pattern", c.sent)
+	}
+	if _, err := fs.ListMatch("/d", "[a-"); err != path.ErrBadPattern {
+		t.Fatalf("ListMatch with a bad pattern: %v, want path.ErrBadPattern", err)
+	}
+}
+
+// globConn is a cmdConn answering MLST which also answers NLST of a
+// pattern as ls does: names starting with a dot need a pattern starting
+// with one, and a matching directory is replaced by its content. It
+// refuses patterns with 550 if noGlob is set.
+type globConn struct {
+	cmdConn
+	noGlob bool
+}
+
+func (c globConn) NameList(name string) ([]string, error) {
+	c.sent = append(c.sent, "NLST "+name)
+	dir, pattern := path.Split(name)
+	dir = path.Clean(dir)
+	if c.noGlob {
+		return nil, &textproto.Error{Code: 550, Msg: "No such file or directory"}
+	}
+	var names []string
+	for _, e := range c.dirs[dir] {
+		ok, _ := path.Match(pattern, e.Name)
+		if !ok || strings.HasPrefix(e.Name, ".") && !strings.HasPrefix(pattern, ".") {
+			continue
+		}
+		if !isDir(e) {
+			names = append(names, path.Join(dir, e.Name))
+			continue
+		}
+		for _, sub := range c.dirs[path.Join(dir, e.Name)] {
+			names = append(names, path.Join(dir, e.Name, sub.Name))
+		}
+	}
+	if len(names) == 0 {
+		return nil, &textproto.Error{Code: 550, Msg: "No files found"}
+	}
+	return names, nil
+}
+
+func TestListMatchServer(t *testing.T) {
+	files := map[string]string{
+		"/d/a.log":         "a",
+		"/d/b.txt":         "b",
+		"/d/c.log":         "c",
+		"/d/old.log/x":     "x",
+		"/d/old.log/y.log": "y",
+		"/d/.hidden.log":   "h",
+	}
+	c := globConn{cmdConn: mlstConn(files, map[string]string{
+		"/d":       "type=dir;modify=20200102030405",
+		"/d/a.log": "type=file;size=1;modify=20200102030405",
+		"/d/c.log": "type=file;size=1;modify=20200102030405",
+	})}
+	fs := NewConn(c)
+	fi, err := fs.ListMatch("/d", "*.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the content of old.log is not mistaken for entries of /d
+	if got := names(fi); got != "a.log c.log" {
+		t.Fatalf("ListMatch(/d, *.log) = %s", got)
+	}
+	if fi[0].Size() != 1 || c.count("NLST /d/*.log") != 1 || c.count("LIST") != 0 {
+		t.Fatalf("sent %q, want NLST of the pattern and MLST of a.log and c.log", c.sent)
+	}
+
+	// without a match, the 550 can not be told from a refused pattern
+	fi, err = fs.ListMatch("/d", "*.zip")
+	if err != nil || len(fi) != 0 {
+		t.Fatalf("ListMatch(/d, *.zip) = %v, %v; want nothing", fi, err)
+	}
+
+	c = globConn{cmdConn: mlstConn(files, nil), noGlob: true}
+	fi, err = NewConn(c).ListMatch("/d", "*.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(fi); got != ".hidden.log a.log c.log old.log" {
+		t.Fatalf("ListMatch(/d, *.log) refused by the server = %s", got)
+	}
+	if c.count("LIST /d") != 1 {
+		t.Fatalf("sent %q, want LIST /d after the refused NLST", c.sent)
+	}
+}
+
+// nlstConn is a fakeConn which answers NLST, see nameLister, with names
+// having their directory if full is set, as some servers do.
+type nlstConn struct {
+	*fakeConn
+	full bool
+}
+
+func (c nlstConn) NameList(name string) ([]string, error) {
+	c.sent = append(c.sent, "NLST "+name)
+	ls, ok := c.dirs[c.abs(name)]
+	if !ok || len(ls) == 0 {
+		// as many servers for an empty directory
+		return nil, &textproto.Error{Code: 550, Msg: "No files found"}
+	}
+	names := []string{".", ".."}
+	for _, e := range ls {
+		n := e.Name
+		if c.full {
+			n = path.Join(name, n)
+		}
+		names = append(names, n)
+	}
+	return names, nil
+}
+
+func TestListNames(t *testing.T) {
+	files := map[string]string{"/d/b.txt": "b", "/d/a.txt": "a", "/d/sub/c.txt": "c", "/empty/": ""}
+	for _, full := range []bool{false, true} {
+		c := nlstConn{newFakeConn(files), full}
+		fs := NewConn(c)
+		got, err := fs.ListNames("/d")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := strings.Join(got, " "); s != "a.txt b.txt sub" {
+			t.Errorf("full paths %t: ListNames(/d) = %s, want a.txt b.txt sub", full, s)
+		}
+		if c.count("LIST") != 0 {
+			t.Errorf("full paths %t: sent %q, want NLST only", full, c.sent)
+		}
+		if got, err := fs.ListNames("/empty"); err != nil || len(got) != 0 {
+			t.Errorf("ListNames of an empty directory = %q, %v", got, err)
+		}
+		if _, err := fs.ListNames("/missing"); err != ErrNotFound {
+			t.Errorf("ListNames of a missing directory: %v, want ErrNotFound", err)
+		}
+	}
+
+	// without NLST, the names are listed
+	got, err := NewConn(newFakeConn(files)).ListNames("/d")
+	if err != nil || strings.Join(got, " ") != "a.txt b.txt sub" {
+		t.Fatalf("ListNames(/d) with LIST = %q, %v", got, err)
+	}
+}
+
+func TestOpenLatest(t *testing.T) {
+	c := newFakeConn(map[string]string{
+		"/builds/app-1.0.zip":  "1.0",
+		"/builds/app-1.1.zip":  "1.1",
+		"/builds/app-0.9.zip":  "0.9",
+		"/builds/notes.txt":    "n",
+		"/builds/app-2.0.zip/": "",
+	})
+	// the latest build is not the last by name, and a directory is not
+	// a build
+	for name, h := range map[string]int{"app-0.9.zip": 1, "app-1.0.zip": 3, "app-1.1.zip": 2, "notes.txt": 4, "app-2.0.zip": 5} {
+		c.entry("/builds/" + name).Time = fakeTime.Add(time.Duration(h) * time.Hour)
+	}
+	fs := NewConn(c)
+	f, fi, err := fs.OpenLatest("/builds", "app-*.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if fi.Name() != "app-1.0.zip" {
+		t.Fatalf("OpenLatest opened %s, want app-1.0.zip", fi.Name())
+	}
+	if b, err := io.ReadAll(f); err != nil || string(b) != "1.0" {
+		t.Fatalf("read %q, %v; want %q", b, err, "1.0")
+	}
+	if _, _, err := fs.OpenLatest("/builds", "*.tar.gz"); err != ErrNotFound {
+		t.Fatalf("OpenLatest without a match: %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,83 @@
+package ftpfs
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/goftp/ftp"
+)
+
+// UnionFS is a http.FileSystem which serves other http.FileSystems, such
+// as FS on different servers or directories, under URL prefixes.
+//
+// Open is routed to the FileSystem with the longest matching prefix.
+// Directories containing mount points but no mounted FileSystem list the
+// mount points as subdirectories.
+//
+// The zero value is an empty UnionFS. Mount must not be called
+// concurrently with Open.
+type UnionFS struct {
+	mounts map[string]http.FileSystem
+}
+
+// Mount serves fs under prefix. Names passed to fs have the prefix
+// stripped. Mounting again at the same prefix replaces the previous one.
+func (u *UnionFS) Mount(prefix string, fs http.FileSystem) {
+	if u.mounts == nil {
+		u.mounts = make(map[string]http.FileSystem)
+	}
+	u.mounts[path.Clean("/"+prefix)] = fs
+}
+
+func (u *UnionFS) Open(name string) (http.File, error) {
+	name = path.Clean("/" + name)
+
+	best := ""
+	for p := range u.mounts {
+		if len(p) > len(best) && underPrefix(name, p) {
+			best = p
+		}
+	}
+	if fs, ok := u.mounts[best]; ok {
+		rest := strings.TrimPrefix(name, best)
+		if !strings.HasPrefix(rest, "/") {
+			rest = "/" + rest
+		}
+		return fs.Open(rest)
+	}
+
+	// synthesize a directory of the mount points below name
+	dir := name
+	if dir != "/" {
+		dir += "/"
+	}
+	seen := make(map[string]bool)
+	var entries []*ftp.Entry
+	for p := range u.mounts {
+		if !strings.HasPrefix(p, dir) {
+			continue
+		}
+		child := p[len(dir):]
+		if i := strings.IndexByte(child, '/'); i >= 0 {
+			child = child[:i]
+		}
+		if child == "" || seen[child] {
+			continue
+		}
+		seen[child] = true
+		entries = append(entries, &ftp.Entry{Name: child, Type: ftp.EntryTypeFolder})
+	}
+	if len(entries) == 0 && name != "/" {
+		return nil, ErrNotFound
+	}
+	return newFtpDir(name, entries), nil
+}
+
+// underPrefix reports whether name is prefix or lies below it.
+func underPrefix(name, prefix string) bool {
+	if prefix == "/" || name == prefix {
+		return true
+	}
+	return strings.HasPrefix(name, prefix+"/")
+}
@@ -0,0 +1,57 @@
+package ftpfs
+
+import "testing"
+
+func TestUnionFS(t *testing.T) {
+	images := NewConn(newFakeConn(map[string]string{"/a.png": "png"}))
+	docs := NewConn(newFakeConn(map[string]string{"/a.txt": "txt", "/old/b.txt": "b"}))
+	old := NewConn(newFakeConn(map[string]string{"/c.txt": "c"}))
+	var u UnionFS
+	u.Mount("/images", images)
+	u.Mount("/shared/docs", docs)
+	u.Mount("/shared/docs/old", old)
+
+	for name, want := range map[string]string{
+		"/images/a.png":          "a.png",
+		"/shared/docs/a.txt":     "a.txt",
+		"/shared/docs/old/c.txt": "c.txt",
+	} {
+		f, err := u.Open(name)
+		if err != nil {
+			t.Fatalf("Open(%q): %v", name, err)
+		}
+		fi, _ := f.Stat()
+		if fi.Name() != want {
+			t.Errorf("Open(%q) = %s, want %s", name, fi.Name(), want)
+		}
+	}
+	// the longest prefix wins
+	if _, err := u.Open("/shared/docs/old/b.txt"); err != ErrNotFound {
+		t.Errorf("Open of a file hidden by a mount: %v, want ErrNotFound", err)
+	}
+
+	for name, want := range map[string][]string{
+		"/":       {"images", "shared"},
+		"/shared": {"docs"},
+	} {
+		f, err := u.Open(name)
+		if err != nil {
+			t.Fatalf("Open(%q): %v", name, err)
+		}
+		fi, err := f.Readdir(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fi) != len(want) {
+			t.Fatalf("Readdir of %s = %v, want %v", name, fi, want)
+		}
+		for i, e := range fi {
+			if e.Name() != want[i] || !e.IsDir() {
+				t.Errorf("Readdir of %s = %v, want directories %v", name, fi, want)
+			}
+		}
+	}
+	if _, err := u.Open("/missing"); err != ErrNotFound {
+		t.Errorf("Open outside the mounts: %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,148 @@
+package ftpfs
+
+import (
+	"context"
+	iofs "io/fs"
+	"os"
+	"path"
+	"sync"
+)
+
+// Walk walks the tree rooted at root as fs.WalkDir does: fn is called for
+// root and everything below it, in lexical order, with FTP paths starting
+// with root. It is called from the goroutine of Walk, one call at a time.
+//
+// Directories are listed ahead, over up to concurrency connections: fs
+// and clones of it, as with GetAll. While fn gets the entries of a
+// directory, its subdirectories are listed in parallel, so the latency
+// to the server is not paid for each directory in turn. A directory
+// which fails to list is reported to fn when its turn comes, as by
+// fs.WalkDir; the walk goes on unless fn returns the error.
+func (fs *FS) Walk(root string, concurrency int, fn iofs.WalkDirFunc) error {
+	fs.mu.Lock()
+	abs, err := fs.abs(root)
+	abs = fs.unroot(abs) // as clones open it again
+	fs.mu.Unlock()
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	fi, err := fs.Stat(abs)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+
+	conns, done := fs.clones(concurrency)
+	defer done()
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &walker{
+		fn:      fn,
+		ctx:     ctx,
+		conns:   make(chan *FS, len(conns)),
+		pending: make(map[string]*prefetch),
+	}
+	for _, c := range conns {
+		w.conns <- c
+	}
+	defer w.wg.Wait()
+	defer cancel()
+
+	err = w.walk(root, abs, iofs.FileInfoToDirEntry(fi))
+	if err == iofs.SkipDir || err == iofs.SkipAll {
+		return nil
+	}
+	return err
+}
+
+// walker is the state of Walk. Only pending listings run in other
+// goroutines, each taking a connection from conns while it lists.
+type walker struct {
+	fn      iofs.WalkDirFunc
+	ctx     context.Context // done once Walk returns
+	conns   chan *FS
+	pending map[string]*prefetch // by absolute path
+	wg      sync.WaitGroup
+}
+
+// prefetch is the listing of a directory, ready once done is closed.
+type prefetch struct {
+	done chan struct{}
+	fi   []os.FileInfo
+	err  error
+}
+
+// prefetch starts listing the directory abs, if not already.
+func (w *walker) prefetch(abs string) {
+	if _, ok := w.pending[abs]; ok {
+		return
+	}
+	p := &prefetch{done: make(chan struct{})}
+	w.pending[abs] = p
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer close(p.done)
+		select {
+		case c := <-w.conns:
+			p.fi, p.err = c.listDir(abs)
+			w.conns <- c
+		case <-w.ctx.Done():
+			// the walk ended before this directory
+			p.err = w.ctx.Err()
+		}
+	}()
+}
+
+// list returns the listing of the directory abs, once prefetched.
+func (w *walker) list(abs string) ([]os.FileInfo, error) {
+	w.prefetch(abs)
+	p := w.pending[abs]
+	delete(w.pending, abs)
+	<-p.done
+	return p.fi, p.err
+}
+
+// walk calls fn for name, at the absolute path abs, and walks it if it is
+// a directory, as fs.WalkDir.
+func (w *walker) walk(name, abs string, d iofs.DirEntry) error {
+	if err := w.fn(name, d, nil); err != nil || !d.IsDir() {
+		if err == iofs.SkipDir && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+	ls, err := w.list(abs)
+	if err != nil {
+		err = w.fn(name, d, err)
+		if err == iofs.SkipDir {
+			err = nil
+		}
+		return err
+	}
+	for _, fi := range ls {
+		if fi.IsDir() {
+			w.prefetch(path.Join(abs, fi.Name()))
+		}
+	}
+	for _, fi := range ls {
+		err := w.walk(path.Join(name, fi.Name()), path.Join(abs, fi.Name()), iofs.FileInfoToDirEntry(fi))
+		if err == iofs.SkipDir {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listDir lists the directory name, sorted by name, for Walk.
+func (fs *FS) listDir(name string) ([]os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	d, err := fs.readDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return d.fi, nil
+}
@@ -0,0 +1,123 @@
+package ftpfs
+
+import (
+	"fmt"
+	iofs "io/fs"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goftp/ftp"
+)
+
+// slowConns counts the LISTs in progress over several connections, which
+// each take some time, and fails the LIST of fail.
+type slowConns struct {
+	mu       sync.Mutex
+	cur, max int
+	fail     string
+}
+
+// slowConn is a fakeConn of slowConns.
+type slowConn struct {
+	*fakeConn
+	s *slowConns
+}
+
+func (c slowConn) List(name string) ([]*ftp.Entry, error) {
+	s := c.s
+	s.mu.Lock()
+	s.cur++
+	if s.cur > s.max {
+		s.max = s.cur
+	}
+	s.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	s.mu.Lock()
+	s.cur--
+	s.mu.Unlock()
+	if name == s.fail {
+		return nil, &textproto.Error{Code: 451, Msg: "Local error"}
+	}
+	return c.fakeConn.List(name)
+}
+
+func TestWalk(t *testing.T) {
+	files := map[string]string{"/r/top.txt": "t"}
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 2; j++ {
+			files[fmt.Sprintf("/r/d%d/e%d/f.txt", i, j)] = "f"
+		}
+	}
+	s := &slowConns{fail: "/r/d2/e1"}
+	cfg := Config{Dial: func(string, *Config) (Conn, error) {
+		return slowConn{newFakeConn(files), s}, nil
+	}}
+	fs, err := DialWithConfig("ftp.example.com:21", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	err = fs.Walk("/r", 4, func(name string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			got = append(got, name+" error")
+			return nil
+		}
+		got = append(got, name)
+		if name == "/r/d3" {
+			return iofs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the order of fs.WalkDir, with the failed listing in its turn
+	var want []string
+	err = iofs.WalkDir(NewConn(newFakeConn(files)).IOFS(), "r", func(name string, d iofs.DirEntry, err error) error {
+		name = "/" + name
+		if name == s.fail {
+			want = append(want, name, name+" error")
+			return iofs.SkipDir
+		}
+		want = append(want, name)
+		if name == "/r/d3" {
+			return iofs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, w := strings.Join(got, "\n"), strings.Join(want, "\n"); g != w {
+		t.Fatalf("walked\n%s\nwant\n%s", g, w)
+	}
+	if s.max < 2 {
+		t.Fatalf("at most %d LIST at a time, want directories listed in parallel", s.max)
+	}
+}
+
+func TestWalkFile(t *testing.T) {
+	fs := NewConn(newFakeConn(map[string]string{"/d/a.txt": "a"}))
+	var got []string
+	err := fs.Walk("/d/a.txt", 2, func(name string, d iofs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			t.Errorf("%s: dir %t, %v; want a file", name, d.IsDir(), err)
+		}
+		got = append(got, name)
+		return nil
+	})
+	if err != nil || strings.Join(got, " ") != "/d/a.txt" {
+		t.Fatalf("Walk of a file = %q, %v", got, err)
+	}
+	err = fs.Walk("/missing", 2, func(name string, d iofs.DirEntry, err error) error {
+		return err
+	})
+	if err != ErrNotFound {
+		t.Fatalf("Walk of a missing root: %v, want ErrNotFound", err)
+	}
+}